@@ -7,14 +7,24 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
+
+	"github.com/axiomhq/axiom-lambda-extension/internal/apierror"
 )
 
 type Client struct {
 	baseURL     string
 	httpClient  *http.Client
 	ExtensionID string
+	// Timeout bounds Register. NextEvent blocks until the next event, however
+	// long the sandbox stays frozen, so it has no timeout of its own.
+	Timeout time.Duration
 }
 
+// StatusError is returned when the Extensions API responds with an unexpected
+// status.
+type StatusError = apierror.StatusError
+
 type RegisterResponse struct {
 	FunctionName    string `json:"functionName"`
 	FunctionVersion string `json:"functionVersion"`
@@ -28,29 +38,56 @@ type Tracing struct {
 
 type EventType string
 
+const (
+	Invoke   EventType = "INVOKE"
+	Shutdown EventType = "SHUTDOWN"
+)
+
+// ShutdownReason is why the sandbox is shutting down, sent with SHUTDOWN.
+type ShutdownReason string
+
+const (
+	ShutdownSpindown ShutdownReason = "spindown"
+	ShutdownTimeout  ShutdownReason = "timeout"
+	ShutdownFailure  ShutdownReason = "failure"
+)
+
 type NextEventResponse struct {
 	EventType          EventType `json:"eventType"`
 	DeadlineMs         int64     `json:"deadlineMs"`
 	RequestID          string    `json:"requestId"`
 	InvokedFunctionArn string    `json:"invokedFunctionArn"`
 	Tracing            Tracing   `json:"tracing"`
+	// TenantID is set for functions using tenant isolation mode.
+	TenantID string `json:"tenantId,omitempty"`
+	// ShutdownReason is only set on SHUTDOWN.
+	ShutdownReason ShutdownReason `json:"shutdownReason,omitempty"`
 }
 
 const (
 	extensionNameHeader       = "Lambda-Extension-Name"
 	extensionIdentifierHeader = "Lambda-Extension-Identifier"
+
+	defaultTimeout = 5 * time.Second
 )
 
 func New(telemetryAPI string) *Client {
 	return &Client{
 		baseURL:    fmt.Sprintf("http://%s/2020-01-01/extension", telemetryAPI),
 		httpClient: &http.Client{},
+		Timeout:    defaultTimeout,
 	}
 }
 
 func (c *Client) Register(ctx context.Context, extensionName string) (*RegisterResponse, error) {
 	registerEndpoint := c.baseURL + "/register"
 
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
 	reqBody, err := json.Marshal(map[string]any{
 		"events": []string{"INVOKE", "SHUTDOWN"},
 	})
@@ -71,7 +108,7 @@ func (c *Client) Register(ctx context.Context, extensionName string) (*RegisterR
 	defer httpRes.Body.Close()
 
 	if httpRes.StatusCode != 200 {
-		return nil, fmt.Errorf("register request failed with status %s", httpRes.Status)
+		return nil, &StatusError{Op: "register", StatusCode: httpRes.StatusCode, Status: httpRes.Status}
 	}
 	body, err := io.ReadAll(httpRes.Body)
 	if err != nil {
@@ -104,7 +141,7 @@ func (c *Client) NextEvent(ctx context.Context, extensionName string) (*NextEven
 	}
 	defer httpRes.Body.Close()
 	if httpRes.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("next event failed with status %s", httpRes.Status)
+		return nil, &StatusError{Op: "next event", StatusCode: httpRes.StatusCode, Status: httpRes.Status}
 	}
 	body, err := io.ReadAll(httpRes.Body)
 	if err != nil {
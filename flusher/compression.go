@@ -0,0 +1,185 @@
+package flusher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/axiomhq/axiom-go/axiom"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+// Compression algorithms for ingest request bodies, selected with
+// AXIOM_COMPRESSION.
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	compressionNone = "none"
+)
+
+var (
+	// compression is the algorithm ingest bodies are compressed with. zstd
+	// costs less CPU and sends fewer bytes than gzip on large batches.
+	compression = compressionGzip
+
+	// compressionLevel is the level for compression: 1-9 for gzip, 1-22 for
+	// zstd. 0 picks the algorithm's default. Override with
+	// AXIOM_COMPRESSION_LEVEL.
+	compressionLevel = 0
+
+	// zstdEncoder is shared by all flushes. EncodeAll is safe for concurrent
+	// use and keeps its per-call state in an internal pool; unlike the
+	// streaming Write/Close API it runs on the caller's goroutine, so a
+	// cancelled flush has no encoder goroutine to strand (issue #48).
+	zstdEncoder     *zstd.Encoder
+	zstdEncoderOnce sync.Once
+	zstdEncoderErr  error
+)
+
+// loadCompressionConfig reads the algorithm and its level; the level is
+// checked against the range of the algorithm.
+func loadCompressionConfig() {
+	if v := os.Getenv("AXIOM_COMPRESSION"); v != "" {
+		switch algo := strings.ToLower(v); algo {
+		case compressionGzip, compressionZstd, compressionNone:
+			compression = algo
+		default:
+			logger.Warn("invalid AXIOM_COMPRESSION, using default",
+				zap.String("value", v), zap.String("default", compression))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_COMPRESSION %q", v))
+		}
+	}
+
+	if v := os.Getenv("AXIOM_COMPRESSION_LEVEL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && validCompressionLevel(compression, n) {
+			compressionLevel = n
+		} else {
+			logger.Warn("invalid AXIOM_COMPRESSION_LEVEL, using default",
+				zap.String("value", v), zap.String("compression", compression))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_COMPRESSION_LEVEL %q for %s", v, compression))
+		}
+	}
+}
+
+func validCompressionLevel(algo string, level int) bool {
+	switch algo {
+	case compressionGzip:
+		return level >= gzip.BestSpeed && level <= gzip.BestCompression
+	case compressionZstd:
+		return level >= 1 && level <= 22
+	default:
+		return false
+	}
+}
+
+// Scratch state reused between flushes to keep allocations, and so GC
+// pressure inside the function's memory budget, down. The encoded body itself
+// is never pooled: net/http may still read a request body after a cancelled
+// request returns, so each body gets a right-sized copy of its own.
+var (
+	bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+	ndjsonPool = sync.Pool{New: func() any { return new(ndjsonEncoder) }}
+	gzipPool   sync.Pool
+)
+
+// encodeBatch serialises events as NDJSON, compressed with the configured
+// algorithm, into an in-memory buffer and returns it with its content
+// encoding. Building the body here (instead of via IngestEvents' streaming
+// io.Pipe) is what makes the flush leak-free: a bytes.Buffer never blocks, so
+// the encoder always finishes and no encoder goroutine can be stranded when a
+// flush is cancelled (see issue #48 and the ingester doc). The returned
+// *bytes.Reader lets net/http rewind the body for the shutdown retry path.
+func encodeBatch(batch []axiom.Event) (*bytes.Reader, axiom.ContentEncoding, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+
+	var (
+		encoding axiom.ContentEncoding
+		body     []byte
+		err      error
+	)
+	switch compression {
+	case compressionZstd:
+		encoding = axiom.Zstd
+		if err = writeNDJSON(buf, batch); err == nil {
+			body, err = encodeZstd(buf.Bytes())
+		}
+	case compressionNone:
+		encoding = axiom.Identity
+		if err = writeNDJSON(buf, batch); err == nil {
+			body = bytes.Clone(buf.Bytes())
+		}
+	default:
+		encoding = axiom.Gzip
+		if err = encodeGzip(buf, batch); err == nil {
+			body = bytes.Clone(buf.Bytes())
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(body), encoding, nil
+}
+
+func writeNDJSON(w io.Writer, batch []axiom.Event) error {
+	enc := ndjsonPool.Get().(*ndjsonEncoder)
+	defer func() {
+		enc.reset()
+		ndjsonPool.Put(enc)
+	}()
+
+	for i := range batch {
+		if err := enc.encode(w, batch[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeGzip writes the gzip-compressed NDJSON of batch to buf.
+func encodeGzip(buf *bytes.Buffer, batch []axiom.Event) error {
+	gz, ok := gzipPool.Get().(*gzip.Writer)
+	if ok {
+		gz.Reset(buf)
+	} else {
+		level := gzip.DefaultCompression
+		if compressionLevel != 0 {
+			level = compressionLevel
+		}
+		var err error
+		if gz, err = gzip.NewWriterLevel(buf, level); err != nil {
+			return err
+		}
+	}
+	defer gzipPool.Put(gz)
+
+	if err := writeNDJSON(gz, batch); err != nil {
+		_ = gz.Close()
+		return err
+	}
+	return gz.Close()
+}
+
+// encodeZstd compresses the whole NDJSON body with a single EncodeAll call.
+func encodeZstd(ndjson []byte) ([]byte, error) {
+	zstdEncoderOnce.Do(func() {
+		level := zstd.SpeedDefault
+		if compressionLevel != 0 {
+			level = zstd.EncoderLevelFromZstd(compressionLevel)
+		}
+		zstdEncoder, zstdEncoderErr = zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(level),
+			zstd.WithEncoderConcurrency(1))
+	})
+	if zstdEncoderErr != nil {
+		return nil, zstdEncoderErr
+	}
+	return zstdEncoder.EncodeAll(ndjson, nil), nil
+}
@@ -0,0 +1,221 @@
+package flusher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/axiomhq/axiom-go/axiom"
+	"go.uber.org/zap"
+)
+
+// Eviction classes, highest priority first. When a buffer is over capacity
+// the lowest-priority events are dropped first.
+const (
+	classError    = "error"
+	classReport   = "report"
+	classWarn     = "warn"
+	classPlatform = "platform"
+	classInfo     = "info"
+	classDebug    = "debug"
+
+	eventTypeEviction = "axiom.eviction"
+)
+
+var evictionClasses = []string{classError, classReport, classWarn, classPlatform, classInfo, classDebug}
+
+// evictionReserve is how many events of each class are kept before any
+// event of a higher-priority class is dropped, so that a flood of errors
+// can't evict every report, for example. Set with AXIOM_EVICTION_RESERVE as
+// comma-separated class=count pairs, e.g. "report=200,debug=50".
+var evictionReserve = map[string]int{}
+
+// loadEvictionConfig reads the per-class reservations of
+// AXIOM_EVICTION_RESERVE.
+func loadEvictionConfig() {
+	v := os.Getenv("AXIOM_EVICTION_RESERVE")
+	if v == "" {
+		return
+	}
+
+	reserve, err := parseEvictionReserve(v)
+	if err != nil {
+		logger.Warn("invalid AXIOM_EVICTION_RESERVE, using default", zap.String("value", v), zap.Error(err))
+		configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_EVICTION_RESERVE %q: %w", v, err))
+		return
+	}
+	evictionReserve = reserve
+}
+
+func parseEvictionReserve(v string) (map[string]int, error) {
+	reserve := make(map[string]int)
+	for _, pair := range strings.Split(v, ",") {
+		class, count, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("expected class=count, got %q", pair)
+		}
+		class = strings.ToLower(strings.TrimSpace(class))
+		if evictionRank(class) < 0 {
+			return nil, fmt.Errorf("unknown class %q", class)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid count for %s: %q", class, count)
+		}
+		reserve[class] = n
+	}
+	return reserve, nil
+}
+
+func evictionRank(class string) int {
+	for i, c := range evictionClasses {
+		if c == class {
+			return i
+		}
+	}
+	return -1
+}
+
+// eventClass returns the eviction class of an event: its log level first,
+// then its type.
+func eventClass(e axiom.Event) string {
+	level, _ := e["level"].(string)
+	if level == "" {
+		if record, ok := e["record"].(map[string]any); ok {
+			level, _ = record["level"].(string)
+		}
+	}
+	switch strings.ToLower(level) {
+	case "error", "fatal", "critical":
+		return classError
+	case "warn", "warning":
+		return classWarn
+	case "debug", "trace":
+		return classDebug
+	case "info":
+		return classInfo
+	}
+
+	typ, _ := e["type"].(string)
+	switch {
+	case typ == "platform.report" || strings.HasPrefix(typ, "axiom."):
+		return classReport
+	case strings.HasPrefix(typ, "platform."):
+		return classPlatform
+	default:
+		return classInfo
+	}
+}
+
+// evict drops excess events from events, which is ordered oldest first. It
+// drops the events of the lowest-priority class beyond its reservation first,
+// the oldest of a class first, and only touches reservations once no class
+// exceeds its own. It returns the kept events in a right-sized slice and the
+// number dropped per class.
+func evict(events []axiom.Event, excess int) ([]axiom.Event, map[string]int) {
+	classes := make([]string, len(events))
+	counts := make(map[string]int, len(evictionClasses))
+	for i, e := range events {
+		classes[i] = eventClass(e)
+		counts[classes[i]]++
+	}
+
+	drop := make(map[string]int, len(evictionClasses))
+	for _, reserved := range []bool{false, true} {
+		for i := len(evictionClasses) - 1; i >= 0 && excess > 0; i-- {
+			class := evictionClasses[i]
+			available := counts[class] - drop[class]
+			if !reserved {
+				available -= evictionReserve[class]
+			}
+			if n := min(available, excess); n > 0 {
+				drop[class] += n
+				excess -= n
+			}
+		}
+	}
+
+	kept := make([]axiom.Event, 0, len(events)-sumCounts(drop))
+	skipped := make(map[string]int, len(drop))
+	for i, e := range events {
+		if skipped[classes[i]] < drop[classes[i]] {
+			skipped[classes[i]]++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept, drop
+}
+
+func sumCounts(counts map[string]int) int {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
+
+// flushEvictions reports the events evicted from a dataset's buffer since its
+// last successful flush with an eviction summary event. It runs after a
+// successful flush, rather than queueing the summary, so that the summary
+// itself can't be evicted or take the place of an event. The counts are put
+// back if the summary can't be sent.
+func (f *Axiom) flushEvictions(ctx context.Context, opt RetryOpt, dataset string) {
+	f.eventsLock.Lock()
+	counts := f.evicted[dataset]
+	delete(f.evicted, dataset)
+	f.eventsLock.Unlock()
+
+	if len(counts) == 0 {
+		return
+	}
+
+	id := dataset
+	if id == "" {
+		id = axiomDataset
+	}
+	evicted := make(map[string]int64, len(counts))
+	var total int64
+	for class, n := range counts {
+		evicted[class] = n
+		total += n
+	}
+	summary := axiom.Event{
+		"_time":   time.Now().UTC().Format(time.RFC3339Nano),
+		"type":    eventTypeEviction,
+		"message": fmt.Sprintf("evicted %d buffered events while ingestion was failing", total),
+		"evicted": evicted,
+		"total":   total,
+	}
+
+	body, encoding, err := encodeBatch([]axiom.Event{summary})
+	if err == nil {
+		_, err = f.clientFor(opt).Ingest(ctx, id, body, axiom.NDJSON, encoding)
+	}
+	if err == nil {
+		return
+	}
+	logger.Error("Failed to ingest eviction summary", zap.String("dataset", id), zap.Error(err))
+	f.eventsLock.Lock()
+	f.recordEvictions(dataset, counts)
+	f.eventsLock.Unlock()
+}
+
+// recordEvictions adds to the evictions pending a summary. Callers must hold
+// eventsLock.
+func (f *Axiom) recordEvictions(dataset string, counts map[string]int64) {
+	if f.evicted == nil {
+		f.evicted = make(map[string]map[string]int64)
+	}
+	pending := f.evicted[dataset]
+	if pending == nil {
+		pending = make(map[string]int64, len(counts))
+		f.evicted[dataset] = pending
+	}
+	for class, n := range counts {
+		pending[class] += n
+	}
+}
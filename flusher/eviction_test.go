@@ -0,0 +1,86 @@
+package flusher
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/axiomhq/axiom-go/axiom"
+)
+
+func TestEvictDropsLowestPriorityFirst(t *testing.T) {
+	events := []axiom.Event{
+		{"n": 0, "level": "error"},
+		{"n": 1, "type": "platform.report"},
+		{"n": 2, "level": "debug"},
+		{"n": 3, "record": map[string]any{"level": "INFO"}},
+		{"n": 4, "level": "debug"},
+		{"n": 5, "type": "platform.start"},
+	}
+
+	kept, dropped := evict(events, 3)
+
+	if len(kept) != 3 {
+		t.Fatalf("expected 3 events kept, got %d", len(kept))
+	}
+	for i, want := range []int{0, 1, 5} {
+		if kept[i]["n"] != want {
+			t.Fatalf("expected error, report and platform events kept, got %v", kept)
+		}
+	}
+	if dropped[classDebug] != 2 || dropped[classInfo] != 1 {
+		t.Fatalf("unexpected eviction counts %v", dropped)
+	}
+}
+
+func TestEvictHonoursReservations(t *testing.T) {
+	prev := evictionReserve
+	evictionReserve = map[string]int{classDebug: 1}
+	defer func() { evictionReserve = prev }()
+
+	events := []axiom.Event{
+		{"n": 0, "level": "debug"},
+		{"n": 1, "level": "debug"},
+		{"n": 2, "level": "error"},
+		{"n": 3, "level": "error"},
+	}
+
+	kept, dropped := evict(events, 2)
+	if dropped[classDebug] != 1 || dropped[classError] != 1 {
+		t.Fatalf("expected the reserved debug event to survive an error, got %v", dropped)
+	}
+	if kept[0]["n"] != 1 || kept[1]["n"] != 3 {
+		t.Fatalf("expected the newest of each class kept, got %v", kept)
+	}
+
+	if _, err := parseEvictionReserve("error=10,bogus=1"); err == nil {
+		t.Fatal("expected unknown class to be rejected")
+	}
+}
+
+func TestEvictionSummaryIsSentAfterSuccessfulFlush(t *testing.T) {
+	prev := maxBufferedEvents
+	maxBufferedEvents = 2
+	defer func() { maxBufferedEvents = prev }()
+
+	fake := &fakeIngester{err: errors.New("boom")}
+	f := newTestAxiom(fake)
+	f.QueueEvents([]axiom.Event{{"level": "debug"}, {"level": "error"}, {"level": "info"}})
+
+	f.Flush(context.Background(), NoRetry)
+	if n := f.bufferLen(); n != 2 {
+		t.Fatalf("expected buffer capped at 2, got %d", n)
+	}
+	if fake.callCount() != 1 {
+		t.Fatalf("expected no summary while ingestion fails, got %d calls", fake.callCount())
+	}
+
+	fake.err = nil
+	f.Flush(context.Background(), NoRetry)
+	if fake.callCount() != 3 {
+		t.Fatalf("expected the batch and the eviction summary, got %d calls", fake.callCount())
+	}
+	if len(f.evicted) != 0 {
+		t.Fatalf("expected pending evictions to be cleared, got %v", f.evicted)
+	}
+}
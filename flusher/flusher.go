@@ -1,15 +1,17 @@
 package flusher
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -31,6 +33,10 @@ const (
 var (
 	axiomToken    = os.Getenv("AXIOM_TOKEN")
 	axiomDataset  = os.Getenv("AXIOM_DATASET")
+	axiomURL      = os.Getenv("AXIOM_URL")
+	axiomEdge     = os.Getenv("AXIOM_EDGE")
+	axiomEdgeURL  = os.Getenv("AXIOM_EDGE_URL")
+	axiomOrgID    = os.Getenv("AXIOM_ORG_ID")
 	batchSize     = 1000
 	flushInterval = 1 * time.Second
 	logger        *zap.Logger
@@ -45,6 +51,18 @@ var (
 	// buffer stays small relative to the smallest (128MB) memory configurations.
 	// Override with AXIOM_MAX_BUFFERED_EVENTS.
 	maxBufferedEvents = 10_000
+
+	// maxDatasetBuffers caps how many datasets other than AXIOM_DATASET may have
+	// events buffered at once (e.g. one per tenant when routing by tenant). Each
+	// such buffer is bounded by maxBufferedEvents, so this bounds the total.
+	// Events for further datasets are held in an overflow buffer, still per
+	// dataset so that tenants' events never mix, that makes the next event
+	// flush and holds maxBufferedEvents events at most; beyond that they are
+	// dropped. Override with AXIOM_MAX_DATASET_BUFFERS.
+	maxDatasetBuffers = 32
+
+	// configErrors is reported by ValidateConfig.
+	configErrors []error
 )
 
 func init() {
@@ -56,8 +74,23 @@ func init() {
 		} else {
 			logger.Warn("invalid AXIOM_MAX_BUFFERED_EVENTS, using default",
 				zap.String("value", v), zap.Int("default", maxBufferedEvents))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_MAX_BUFFERED_EVENTS %q", v))
+		}
+	}
+
+	if v := os.Getenv("AXIOM_MAX_DATASET_BUFFERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			maxDatasetBuffers = n
+		} else {
+			logger.Warn("invalid AXIOM_MAX_DATASET_BUFFERS, using default",
+				zap.String("value", v), zap.Int("default", maxDatasetBuffers))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_MAX_DATASET_BUFFERS %q", v))
 		}
 	}
+
+	// read here, once the logger they warn with is set up
+	loadCompressionConfig()
+	loadEvictionConfig()
 }
 
 // ingester is the subset of *axiom.Client the flusher depends on. Depending on an
@@ -77,23 +110,65 @@ type ingester interface {
 }
 
 type Axiom struct {
-	client        ingester
-	retryClient   ingester
-	events        []axiom.Event
+	client      ingester
+	retryClient ingester
+	transport   *http.Transport
+	events      []axiom.Event
+	// routed buffers events for datasets other than AXIOM_DATASET, keyed by
+	// dataset name. It is guarded by eventsLock, like events.
+	routed        map[string][]axiom.Event
 	eventsLock    sync.Mutex
 	lastFlushTime time.Time
+
+	// overflow holds the events of datasets that found every routed buffer
+	// taken, overflowLen their number. overflowed counts all events ever held
+	// there, for Stats. They are guarded by eventsLock.
+	overflow    map[string][]axiom.Event
+	overflowLen int
+	overflowed  int64
+
+	// routedOverflowWarned is set once an overflow was logged, until the
+	// next flush frees the buffers.
+	routedOverflowWarned bool
+
+	// lastFlushErr and its time, and dropped, the events requeue dropped, are
+	// kept for Stats. They are guarded by eventsLock.
+	lastFlushErr     error
+	lastFlushErrTime time.Time
+	dropped          int64
+
+	// evicted counts the events evicted per dataset and class since the
+	// dataset's last successful flush (see flushEvictions). It is guarded by
+	// eventsLock.
+	evicted map[string]map[string]int64
+}
+
+// Stats is a snapshot of the flusher's state, for debugging.
+type Stats struct {
+	Buffered          int            `json:"buffered"`
+	BufferedByDataset map[string]int `json:"bufferedByDataset,omitempty"`
+	MaxBuffered       int            `json:"maxBuffered"`
+	Dropped           int64          `json:"dropped"`
+	Overflowed        int64          `json:"overflowed"`
+	LastFlush         time.Time      `json:"lastFlush"`
+	LastFlushError    string         `json:"lastFlushError,omitempty"`
+	LastFlushErrorAt  *time.Time     `json:"lastFlushErrorAt,omitempty"`
 }
 
 func New() (*Axiom, error) {
+	if errs := validateEndpoint(); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
 	// We create two almost identical clients, but one will retry and one will
 	// not. This is mostly because we are just waiting for the next flush with
 	// the next event most of the time, but want to retry on exit/shutdown.
 
-	opts := make([]axiom.Option, 0, 3)
-	opts = append(opts,
-		axiom.SetAPITokenConfig(axiomToken),
-		axiom.SetUserAgent(fmt.Sprintf("axiom-lambda-extension/%s", version.Get())),
-	)
+	// Both clients share a transport we own, so its pooled connections can be
+	// dropped after a SnapStart restore (see Restored).
+	transport := newTransport()
+
+	opts := clientOptions(&http.Client{Transport: transport, Timeout: 5 * time.Minute})
 
 	retryClient, err := axiom.NewClient(opts...)
 	if err != nil {
@@ -109,17 +184,237 @@ func New() (*Axiom, error) {
 	f := &Axiom{
 		client:      client,
 		retryClient: retryClient,
+		transport:   transport,
 		events:      make([]axiom.Event, 0),
 	}
 
 	return f, nil
 }
 
+// clientOptions returns the options both Axiom clients are built with. Every
+// setting is read by this package and passed explicitly; SetNoEnv keeps
+// axiom-go from picking up AXIOM_* variables on its own, so what validate and
+// the health metadata report is exactly what the client uses.
+func clientOptions(httpClient *http.Client) []axiom.Option {
+	opts := make([]axiom.Option, 0, 8)
+	opts = append(opts,
+		axiom.SetNoEnv(),
+		axiom.SetToken(axiomToken),
+		axiom.SetUserAgent(fmt.Sprintf("axiom-lambda-extension/%s", version.Get())),
+		axiom.SetClient(httpClient),
+	)
+	if axiomURL != "" {
+		opts = append(opts, axiom.SetURL(axiomURL))
+	}
+	if axiomEdgeURL != "" {
+		opts = append(opts, axiom.SetEdgeURL(axiomEdgeURL))
+	}
+	if axiomEdge != "" {
+		opts = append(opts, axiom.SetEdge(axiomEdge))
+	}
+	if axiomOrgID != "" {
+		opts = append(opts, axiom.SetOrganizationID(axiomOrgID))
+	}
+	return opts
+}
+
+// validateEndpoint checks the endpoint settings, which axiom-go would otherwise
+// only reject (or silently misuse) on the first ingest.
+func validateEndpoint() []error {
+	var errs []error
+	if err := validateURL(axiomURL); err != nil {
+		errs = append(errs, fmt.Errorf("invalid AXIOM_URL: %w", err))
+	}
+	if err := validateURL(axiomEdgeURL); err != nil {
+		errs = append(errs, fmt.Errorf("invalid AXIOM_EDGE_URL: %w", err))
+	}
+	if strings.Contains(axiomEdge, "/") {
+		errs = append(errs, fmt.Errorf("invalid AXIOM_EDGE %q: expected a domain such as eu-central-1.aws.edge.axiom.co, use AXIOM_EDGE_URL for URLs", axiomEdge))
+	}
+	if strings.HasPrefix(axiomToken, "xapt-") && axiomOrgID == "" {
+		errs = append(errs, errors.New("AXIOM_ORG_ID must be set when AXIOM_TOKEN is a personal token"))
+	}
+	return errs
+}
+
+func validateURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) URL", raw)
+	}
+	return nil
+}
+
+// EndpointInfo describes where events are sent, for the extension's health
+// metadata. Only explicitly configured settings are included.
+func EndpointInfo() map[string]string {
+	info := make(map[string]string, 4)
+	if axiomURL != "" {
+		info["url"] = axiomURL
+	}
+	if axiomEdge != "" {
+		info["edge"] = axiomEdge
+	}
+	if axiomEdgeURL != "" {
+		info["edgeUrl"] = axiomEdgeURL
+	}
+	if axiomOrgID != "" {
+		info["orgId"] = axiomOrgID
+	}
+	return info
+}
+
+// ValidateConfig reports every problem with the flusher's configuration: the
+// settings init had to ignore, and settings the Axiom client would reject.
+func ValidateConfig() []error {
+	errs := append([]error(nil), configErrors...)
+	endpointErrs := validateEndpoint()
+	errs = append(errs, endpointErrs...)
+
+	if axiomToken == "" {
+		errs = append(errs, errors.New("AXIOM_TOKEN is not set"))
+	} else if len(endpointErrs) == 0 {
+		// with invalid endpoints the client would only repeat those problems
+		if _, err := axiom.NewClient(clientOptions(nil)...); err != nil {
+			errs = append(errs, fmt.Errorf("invalid Axiom client configuration: %w", err))
+		}
+	}
+	if axiomDataset == "" {
+		errs = append(errs, errors.New("AXIOM_DATASET is not set"))
+	}
+
+	return errs
+}
+
+// IngestTestEvent ingests a single event into AXIOM_DATASET, checking that the
+// endpoint is reachable and that the token may ingest into the dataset.
+func (f *Axiom) IngestTestEvent(ctx context.Context) error {
+	body, encoding, err := encodeBatch([]axiom.Event{{
+		"_time":   time.Now().UTC().Format(time.RFC3339Nano),
+		"type":    "axiom.validate",
+		"message": "axiom-lambda-extension configuration check",
+		"axiom":   map[string]string{"awsLambdaExtensionVersion": version.Get()},
+	}})
+	if err != nil {
+		return err
+	}
+
+	res, err := f.retryClient.Ingest(ctx, axiomDataset, body, axiom.NDJSON, encoding)
+	if err != nil {
+		return err
+	}
+	if res.Failed > 0 {
+		return fmt.Errorf("test event was rejected: %s", res.Failures[0].Error)
+	}
+	return nil
+}
+
+// newTransport mirrors the connection settings of axiom-go's default transport.
+// We can't use that one directly: its wrappers hide CloseIdleConnections.
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		IdleConnTimeout:       time.Minute,
+		ResponseHeaderTimeout: 2 * time.Minute,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+}
+
+// Restored resets state that doesn't survive a SnapStart snapshot. Pooled
+// connections were opened by a different sandbox (and possibly hours ago), so
+// they are closed rather than reused, and the flush timer is reset so events
+// buffered before the snapshot are sent with the first post-restore event.
+func (f *Axiom) Restored() {
+	if f.transport != nil {
+		f.transport.CloseIdleConnections()
+	}
+
+	f.eventsLock.Lock()
+	defer f.eventsLock.Unlock()
+	f.lastFlushTime = time.Time{}
+}
+
 func (f *Axiom) ShouldFlush() bool {
 	f.eventsLock.Lock()
 	defer f.eventsLock.Unlock()
 
-	return len(f.events) > batchSize || f.lastFlushTime.IsZero() || time.Since(f.lastFlushTime) > flushInterval
+	buffered := len(f.events) + f.overflowLen
+	for _, events := range f.routed {
+		buffered += len(events)
+	}
+
+	// held overflow is flushed early, to free its tenants' events soon
+	return buffered > batchSize || f.overflowLen > 0 || f.lastFlushTime.IsZero() || time.Since(f.lastFlushTime) > flushInterval
+}
+
+// Full reports whether a buffer holds more than maxBufferedEvents events, the
+// excess a failed flush will evict. Producers that can have their input
+// retried by the sender should push back rather than queue more. A buffer
+// merely at the cap, as a failed flush leaves it, still takes new events, so
+// that they compete with the buffered ones by priority on the next eviction.
+func (f *Axiom) Full() bool {
+	f.eventsLock.Lock()
+	defer f.eventsLock.Unlock()
+
+	if len(f.events) > maxBufferedEvents {
+		return true
+	}
+	for _, events := range f.routed {
+		if len(events) > maxBufferedEvents {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats returns a snapshot of the flusher's buffers and the outcome of its
+// flushes.
+func (f *Axiom) Stats() Stats {
+	f.eventsLock.Lock()
+	defer f.eventsLock.Unlock()
+
+	stats := Stats{
+		Buffered:    len(f.events),
+		MaxBuffered: maxBufferedEvents,
+		Dropped:     f.dropped,
+		Overflowed:  f.overflowed,
+		LastFlush:   f.lastFlushTime,
+	}
+	if len(f.routed) > 0 || len(f.overflow) > 0 {
+		stats.BufferedByDataset = make(map[string]int, len(f.routed)+len(f.overflow))
+		for _, buffers := range []map[string][]axiom.Event{f.routed, f.overflow} {
+			for dataset, events := range buffers {
+				stats.BufferedByDataset[dataset] += len(events)
+				stats.Buffered += len(events)
+			}
+		}
+	}
+	if f.lastFlushErr != nil {
+		at := f.lastFlushErrTime
+		stats.LastFlushError = f.lastFlushErr.Error()
+		stats.LastFlushErrorAt = &at
+	}
+	return stats
+}
+
+// recordFlushError remembers a failed flush for Stats.
+func (f *Axiom) recordFlushError(err error) {
+	f.eventsLock.Lock()
+	defer f.eventsLock.Unlock()
+
+	f.lastFlushErr, f.lastFlushErrTime = err, time.Now()
 }
 
 func (f *Axiom) Queue(event axiom.Event) {
@@ -136,99 +431,177 @@ func (f *Axiom) QueueEvents(events []axiom.Event) {
 	f.events = append(f.events, events...)
 }
 
+// QueueEventsTo queues events for the given dataset rather than AXIOM_DATASET.
+// When maxDatasetBuffers other datasets already have events buffered, the
+// events are held in the overflow buffer, which the next flush sends to their
+// dataset, and dropped once it is full.
+func (f *Axiom) QueueEventsTo(dataset string, events []axiom.Event) {
+	if dataset == "" || dataset == axiomDataset {
+		f.QueueEvents(events)
+		return
+	}
+
+	f.eventsLock.Lock()
+	defer f.eventsLock.Unlock()
+
+	if _, ok := f.routed[dataset]; !ok && len(f.routed) >= maxDatasetBuffers {
+		f.holdOverflow(dataset, events)
+		return
+	}
+
+	if f.routed == nil {
+		f.routed = make(map[string][]axiom.Event)
+	}
+	f.routed[dataset] = append(f.routed[dataset], events...)
+}
+
+// holdOverflow holds the events of a dataset that found every routed buffer
+// taken. Callers must hold eventsLock.
+func (f *Axiom) holdOverflow(dataset string, events []axiom.Event) {
+	held := min(len(events), maxBufferedEvents-f.overflowLen)
+	if !f.routedOverflowWarned {
+		f.routedOverflowWarned = true
+		logger.Warn("too many dataset buffers; holding events until the next flush",
+			zap.String("dataset", dataset),
+			zap.Int("max_dataset_buffers", maxDatasetBuffers))
+	}
+	if held < len(events) {
+		f.dropped += int64(len(events) - held)
+	}
+	if held <= 0 {
+		return
+	}
+
+	if f.overflow == nil {
+		f.overflow = make(map[string][]axiom.Event)
+	}
+	// the newest events are kept, like requeue keeps them
+	f.overflow[dataset] = append(f.overflow[dataset], events[len(events)-held:]...)
+	f.overflowLen += held
+	f.overflowed += int64(held)
+}
+
 // Flush sends the buffered events to Axiom. The provided context bounds the
 // ingest call: when it is cancelled (e.g. the per-invocation deadline is reached),
 // the in-flight request is aborted so the extension can hand control back to the
 // Lambda runtime instead of holding the sandbox open until the function times out
-// (see issue #48). On failure the batch is requeued for a later attempt, bounded
-// by maxBufferedEvents.
+// (see issue #48). Every dataset with buffered events is ingested separately. On
+// failure a dataset's batch is requeued for a later attempt, bounded by
+// maxBufferedEvents.
 func (f *Axiom) Flush(ctx context.Context, opt RetryOpt) {
 	f.eventsLock.Lock()
 	var batch []axiom.Event
 	// create a copy of the batch, clear the original
 	batch, f.events = f.events, []axiom.Event{}
+	routed, overflow := f.routed, f.overflow
+	f.routed, f.overflow, f.overflowLen = nil, nil, 0
+	f.routedOverflowWarned = false
 	f.lastFlushTime = time.Now()
 	f.eventsLock.Unlock()
 
+	f.flushBatch(ctx, opt, "", batch)
+	for _, buffers := range []map[string][]axiom.Event{routed, overflow} {
+		for dataset, events := range buffers {
+			f.flushBatch(ctx, opt, dataset, events)
+		}
+	}
+}
+
+// flushBatch ingests a batch into dataset, where "" is AXIOM_DATASET, and
+// requeues it on failure.
+func (f *Axiom) flushBatch(ctx context.Context, opt RetryOpt, dataset string, batch []axiom.Event) {
 	if len(batch) == 0 {
 		return
 	}
 
-	body, err := encodeBatch(batch)
+	body, encoding, err := encodeBatch(batch)
 	if err != nil {
 		// Encoding failure is not transient, but requeue (bounded) so a later
 		// flush can retry rather than silently dropping the batch.
 		logger.Error("Failed to encode events", zap.Error(err))
-		f.requeue(batch)
+		f.recordFlushError(err)
+		f.requeue(dataset, batch)
 		return
 	}
 
-	var res *ingest.Status
-	if opt == Retry {
-		res, err = f.retryClient.Ingest(ctx, axiomDataset, body, axiom.NDJSON, axiom.Gzip)
-	} else {
-		res, err = f.client.Ingest(ctx, axiomDataset, body, axiom.NDJSON, axiom.Gzip)
+	id := dataset
+	if id == "" {
+		id = axiomDataset
 	}
 
+	var res *ingest.Status
+	res, err = f.clientFor(opt).Ingest(ctx, id, body, axiom.NDJSON, encoding)
+
 	if err != nil {
 		if opt == Retry {
-			logger.Error("Failed to ingest events", zap.Error(err))
+			logger.Error("Failed to ingest events", zap.String("dataset", id), zap.Error(err))
 		} else {
-			logger.Error("Failed to ingest events (will try again with next event)", zap.Error(err))
+			logger.Error("Failed to ingest events (will try again with next event)", zap.String("dataset", id), zap.Error(err))
 		}
+		f.recordFlushError(err)
 		// Allow this batch to be retried again by putting it back in front of any
 		// events queued since, keeping the buffer bounded.
-		f.requeue(batch)
+		f.requeue(dataset, batch)
 
 		return
 	} else if res.Failed > 0 {
 		log.Printf("%d failures during ingesting, %s", res.Failed, res.Failures[0].Error)
 	}
+
+	f.flushEvictions(ctx, opt, dataset)
 }
 
-// encodeBatch serialises events as gzip-compressed NDJSON into an in-memory
-// buffer. Building the body here (instead of via IngestEvents' streaming io.Pipe)
-// is what makes the flush leak-free: a bytes.Buffer never blocks, so the gzip
-// writer always closes cleanly and no encoder goroutine can be stranded when a
-// flush is cancelled (see issue #48 and the ingester doc above). The returned
-// *bytes.Reader lets net/http rewind the body for the shutdown retry path.
-func encodeBatch(batch []axiom.Event) (*bytes.Reader, error) {
-	var buf bytes.Buffer
-	gz := gzip.NewWriter(&buf)
-	enc := json.NewEncoder(gz)
-	for i := range batch {
-		if err := enc.Encode(batch[i]); err != nil {
-			_ = gz.Close()
-			return nil, err
-		}
-	}
-	if err := gz.Close(); err != nil {
-		return nil, err
+// clientFor returns the client to flush with.
+func (f *Axiom) clientFor(opt RetryOpt) ingester {
+	if opt == Retry {
+		return f.retryClient
 	}
-	return bytes.NewReader(buf.Bytes()), nil
+	return f.client
 }
 
-// requeue puts a failed batch back at the front of the buffer, dropping the
-// oldest events when the buffer would exceed maxBufferedEvents. Dropping oldest
-// (rather than rejecting new) keeps the most recent logs, and copying into a
-// right-sized slice releases the dropped events' backing array to the GC so a
-// sustained outage cannot grow memory without bound (issue #48).
-func (f *Axiom) requeue(batch []axiom.Event) {
+// requeue puts a failed batch back at the front of its dataset's buffer ("" is
+// AXIOM_DATASET), evicting events when the buffer would exceed
+// maxBufferedEvents. Eviction drops the lowest-priority events first (see
+// evict), so that an outage costs DEBUG chatter before it costs errors and
+// reports, and copying into a right-sized slice releases the dropped events'
+// backing array to the GC so a sustained outage cannot grow memory without bound
+// (issue #48). What was evicted is reported once a flush succeeds again.
+func (f *Axiom) requeue(dataset string, batch []axiom.Event) {
 	f.eventsLock.Lock()
-	combined := append(batch, f.events...)
+	buffered := f.events
+	if dataset != "" {
+		buffered = f.routed[dataset]
+	}
+	combined := append(batch, buffered...)
 	dropped := 0
+	var evicted map[string]int
 	if len(combined) > maxBufferedEvents {
 		dropped = len(combined) - maxBufferedEvents
-		trimmed := make([]axiom.Event, maxBufferedEvents)
-		copy(trimmed, combined[dropped:])
-		combined = trimmed
+		combined, evicted = evict(combined, dropped)
+		counts := make(map[string]int64, len(evicted))
+		for class, n := range evicted {
+			counts[class] = int64(n)
+		}
+		f.recordEvictions(dataset, counts)
+	}
+	if dataset == "" {
+		f.events = combined
+	} else {
+		// A failed dataset keeps its buffer even past maxDatasetBuffers: it
+		// already held one before the flush.
+		if f.routed == nil {
+			f.routed = make(map[string][]axiom.Event)
+		}
+		f.routed[dataset] = combined
 	}
-	f.events = combined
+	f.dropped += int64(dropped)
 	f.eventsLock.Unlock()
 
 	if dropped > 0 {
-		logger.Warn("event buffer full; dropped oldest events to bound memory (issue #48)",
+		logger.Warn("event buffer full; evicted lowest-priority events to bound memory (issue #48)",
+			zap.String("dataset", dataset),
 			zap.Int("dropped", dropped),
+			zap.Any("evicted", evicted),
 			zap.Int("max_buffered_events", maxBufferedEvents))
 	}
 }
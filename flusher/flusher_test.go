@@ -1,6 +1,7 @@
 package flusher
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
@@ -14,15 +15,17 @@ import (
 
 // fakeIngester is a test double for the ingester interface.
 type fakeIngester struct {
-	mu    sync.Mutex
-	calls int
-	err   error
-	block bool // if true, block until the context is cancelled
+	mu       sync.Mutex
+	calls    int
+	datasets []string
+	err      error
+	block    bool // if true, block until the context is cancelled
 }
 
-func (f *fakeIngester) Ingest(ctx context.Context, _ string, r io.Reader, _ axiom.ContentType, _ axiom.ContentEncoding, _ ...ingest.Option) (*ingest.Status, error) {
+func (f *fakeIngester) Ingest(ctx context.Context, id string, r io.Reader, _ axiom.ContentType, _ axiom.ContentEncoding, _ ...ingest.Option) (*ingest.Status, error) {
 	f.mu.Lock()
 	f.calls++
+	f.datasets = append(f.datasets, id)
 	f.mu.Unlock()
 
 	if f.block {
@@ -110,6 +113,28 @@ func TestFlushRequeueIsBounded(t *testing.T) {
 	}
 }
 
+func TestFullOnceABufferExceedsTheCap(t *testing.T) {
+	prev := maxBufferedEvents
+	maxBufferedEvents = 2
+	defer func() { maxBufferedEvents = prev }()
+
+	f := newTestAxiom(&fakeIngester{})
+	f.QueueEvents([]axiom.Event{{"n": 0}, {"n": 1}})
+	if f.Full() {
+		t.Fatal("expected buffer at the cap not to be full")
+	}
+
+	f.QueueEventsTo("tenant-a", []axiom.Event{{"n": 1}, {"n": 2}, {"n": 3}})
+	if !f.Full() {
+		t.Fatal("expected a dataset buffer past the cap to make the flusher full")
+	}
+
+	f.Flush(context.Background(), NoRetry)
+	if f.Full() {
+		t.Fatal("expected a successful flush to make room")
+	}
+}
+
 func TestFlushRespectsContextCancellation(t *testing.T) {
 	fake := &fakeIngester{block: true}
 	f := newTestAxiom(fake)
@@ -146,3 +171,128 @@ func TestFlushEmptyBufferIsNoop(t *testing.T) {
 		t.Fatalf("expected no ingest call for empty buffer, got %d", got)
 	}
 }
+
+func TestRestoredResetsFlushTimer(t *testing.T) {
+	fake := &fakeIngester{}
+	f := newTestAxiom(fake)
+	f.QueueEvents([]axiom.Event{{"a": 1}})
+	f.Flush(context.Background(), NoRetry)
+
+	if f.ShouldFlush() {
+		t.Fatal("expected no flush right after a flush")
+	}
+
+	f.Restored()
+
+	if !f.ShouldFlush() {
+		t.Fatal("expected restore to reset the flush timer")
+	}
+}
+
+func TestQueueEventsToRoutesAndBoundsDatasetBuffers(t *testing.T) {
+	prev := maxDatasetBuffers
+	maxDatasetBuffers = 1
+	defer func() { maxDatasetBuffers = prev }()
+
+	fake := &fakeIngester{}
+	f := newTestAxiom(fake)
+	f.QueueEventsTo("logs-a", []axiom.Event{{"tenant": "a"}})
+	// Over the limit: held for its own dataset, never mixed into the default.
+	f.QueueEventsTo("logs-b", []axiom.Event{{"tenant": "b"}})
+
+	if n := f.bufferLen(); n != 0 {
+		t.Fatalf("expected no overflow in the default buffer, got %d events", n)
+	}
+	if stats := f.Stats(); stats.Overflowed != 1 || stats.BufferedByDataset["logs-b"] != 1 {
+		t.Fatalf("expected the overflow held for logs-b, got %+v", stats)
+	}
+	if !f.ShouldFlush() {
+		t.Fatal("expected held overflow to make the next event flush")
+	}
+
+	f.Flush(context.Background(), NoRetry)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.datasets) != 2 || fake.datasets[0] != "logs-a" || fake.datasets[1] != "logs-b" {
+		t.Fatalf("expected ingest into logs-a and logs-b, got %q", fake.datasets)
+	}
+}
+
+func TestOverflowIsBounded(t *testing.T) {
+	prevBuffers, prevEvents := maxDatasetBuffers, maxBufferedEvents
+	maxDatasetBuffers, maxBufferedEvents = 0, 2
+	defer func() { maxDatasetBuffers, maxBufferedEvents = prevBuffers, prevEvents }()
+
+	f := newTestAxiom(&fakeIngester{})
+	f.QueueEventsTo("logs-a", []axiom.Event{{"n": 0}})
+	f.QueueEventsTo("logs-b", []axiom.Event{{"n": 1}, {"n": 2}})
+
+	stats := f.Stats()
+	if stats.Buffered != 2 || stats.Dropped != 1 || stats.BufferedByDataset["logs-b"] != 1 {
+		t.Fatalf("expected the overflow capped at 2 events, got %+v", stats)
+	}
+	if got := f.overflow["logs-b"][0]["n"]; got != 2 {
+		t.Fatalf("expected the newest overflow event kept, got %v", got)
+	}
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	prevURL, prevEdge, prevToken, prevOrg := axiomURL, axiomEdge, axiomToken, axiomOrgID
+	defer func() { axiomURL, axiomEdge, axiomToken, axiomOrgID = prevURL, prevEdge, prevToken, prevOrg }()
+
+	axiomURL, axiomEdge, axiomToken, axiomOrgID = "https://axiom.example.com", "eu-central-1.aws.edge.axiom.co", "xaat-token", ""
+	if errs := validateEndpoint(); len(errs) != 0 {
+		t.Fatalf("expected valid endpoint, got %v", errs)
+	}
+
+	axiomURL, axiomEdge, axiomToken = "axiom.example.com", "https://eu-central-1.aws.edge.axiom.co", "xapt-token"
+	if errs := validateEndpoint(); len(errs) != 3 {
+		t.Fatalf("expected URL, edge and org ID problems, got %v", errs)
+	}
+}
+
+func TestEncodeBatchRoundTripsEachCompression(t *testing.T) {
+	for _, tc := range []struct {
+		algo     string
+		encoding axiom.ContentEncoding
+	}{
+		{compressionGzip, axiom.Gzip},
+		{compressionZstd, axiom.Zstd},
+		{compressionNone, axiom.Identity},
+	} {
+		t.Run(tc.algo, func(t *testing.T) {
+			prev := compression
+			compression = tc.algo
+			defer func() { compression = prev }()
+
+			_, encoding, err := encodeBatch([]axiom.Event{{"n": 1}})
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if encoding != tc.encoding {
+				t.Fatalf("expected encoding %v, got %v", tc.encoding, encoding)
+			}
+
+			var out bytes.Buffer
+			f := NewWriter(&out)
+			f.QueueEvents([]axiom.Event{{"n": 1}, {"n": 2}})
+			f.Flush(context.Background(), NoRetry)
+			if got := out.String(); got != "{\"n\":1}\n{\"n\":2}\n" {
+				t.Fatalf("unexpected decoded body %q", got)
+			}
+		})
+	}
+}
+
+func TestValidCompressionLevel(t *testing.T) {
+	if !validCompressionLevel(compressionGzip, 9) || validCompressionLevel(compressionGzip, 10) {
+		t.Fatal("expected gzip levels 1-9")
+	}
+	if !validCompressionLevel(compressionZstd, 22) || validCompressionLevel(compressionZstd, 0) {
+		t.Fatal("expected zstd levels 1-22")
+	}
+	if validCompressionLevel(compressionNone, 1) {
+		t.Fatal("expected no levels without compression")
+	}
+}
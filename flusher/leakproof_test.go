@@ -16,11 +16,23 @@ import (
 // path (axiom-go IngestEvents) streamed events through an io.Pipe fed by a
 // background zstd encoder goroutine; a cancelled or stalled flush left that
 // goroutine blocked forever in Encoder.Close -> PipeWriter.Write, leaking it and
-// its ~4MB compression buffer on every flush. The in-memory gzip Ingest path used
-// by the flusher must spawn no such goroutine. We drive many flushes against a
-// server that stalls until the client cancels, then assert no zstd / io.Pipe
-// goroutines remain.
+// its ~4MB compression buffer on every flush. The in-memory Ingest path used by
+// the flusher must spawn no such goroutine, whichever encoder is configured. We
+// drive many flushes against a server that stalls until the client cancels, then
+// assert no zstd / io.Pipe goroutines remain.
 func TestFlushDoesNotStrandStreamingEncoder(t *testing.T) {
+	for _, algo := range []string{compressionGzip, compressionZstd, compressionNone} {
+		t.Run(algo, func(t *testing.T) {
+			prev := compression
+			compression = algo
+			defer func() { compression = prev }()
+
+			testFlushDoesNotStrandEncoder(t)
+		})
+	}
+}
+
+func testFlushDoesNotStrandEncoder(t *testing.T) {
 	release := make(chan struct{})
 	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
 		select {
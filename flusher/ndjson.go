@@ -0,0 +1,118 @@
+package flusher
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"slices"
+
+	"github.com/axiomhq/axiom-go/axiom"
+)
+
+// sharedFields are the enrichment fields whose value is usually the same map
+// for every event of a batch: the server attaches one snapshot of its metadata
+// to many events and never mutates a map once it is attached. Their encoding
+// is cached by map identity for the length of a batch.
+var sharedFields = map[string]bool{
+	"axiom":  true,
+	"lambda": true,
+}
+
+// ndjsonEncoder writes events as NDJSON, byte for byte as json.Encoder would,
+// but without re-encoding the shared metadata maps for every event. It reuses
+// its scratch space between events and batches, so it is pooled rather than
+// created per flush. It is not safe for concurrent use.
+type ndjsonEncoder struct {
+	buf  []byte
+	keys []string
+	// shared caches the encoding of the sharedFields values seen in the
+	// current batch, keyed by map pointer.
+	shared map[uintptr][]byte
+}
+
+// reset forgets the cached encodings: a map pointer is only known to stand for
+// the same contents while the batch holding the map is being encoded.
+func (e *ndjsonEncoder) reset() {
+	clear(e.shared)
+}
+
+// encode writes a single event followed by a newline to w.
+func (e *ndjsonEncoder) encode(w io.Writer, event axiom.Event) error {
+	e.keys = e.keys[:0]
+	for k := range event {
+		e.keys = append(e.keys, k)
+	}
+	slices.Sort(e.keys)
+
+	buf := append(e.buf[:0], '{')
+	for i, k := range e.keys {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		var err error
+		if buf, err = appendString(buf, k); err != nil {
+			return err
+		}
+		buf = append(buf, ':')
+
+		if s, ok := event[k].(string); ok {
+			buf, err = appendString(buf, s)
+		} else {
+			var value []byte
+			value, err = e.value(k, event[k])
+			buf = append(buf, value...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	buf = append(buf, '}', '\n')
+	e.buf = buf
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// value returns the encoding of a field's value, from the cache for shared
+// metadata maps.
+func (e *ndjsonEncoder) value(key string, v any) ([]byte, error) {
+	if !sharedFields[key] {
+		return json.Marshal(v)
+	}
+
+	var ptr uintptr
+	switch v.(type) {
+	case map[string]any, map[string]string:
+		ptr = reflect.ValueOf(v).Pointer()
+	default:
+		return json.Marshal(v)
+	}
+
+	if cached, ok := e.shared[ptr]; ok {
+		return cached, nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if e.shared == nil {
+		e.shared = make(map[uintptr][]byte)
+	}
+	e.shared[ptr] = encoded
+	return encoded, nil
+}
+
+// appendString appends s as a JSON string. Strings that need no escaping, the
+// common case for keys and most values, are copied as they are; the others are
+// left to encoding/json so that the output matches it exactly.
+func appendString(buf []byte, s string) ([]byte, error) {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x80 || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			encoded, err := json.Marshal(s)
+			return append(buf, encoded...), err
+		}
+	}
+	buf = append(buf, '"')
+	buf = append(buf, s...)
+	return append(buf, '"'), nil
+}
@@ -0,0 +1,72 @@
+package flusher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/axiomhq/axiom-go/axiom"
+)
+
+func TestNDJSONEncoderMatchesEncodingJSON(t *testing.T) {
+	lambda := map[string]any{"name": "fn", "memorySizeMB": int64(128), "region": "eu-west-1"}
+	meta := map[string]string{"awsLambdaExtensionVersion": "v1", "url": "https://api.axiom.co"}
+	batch := []axiom.Event{
+		{"_time": "2024-01-16T08:53:51Z", "type": "function", "record": "a <b> & \"c\"\n", "lambda": lambda, "axiom": meta},
+		{"type": "platform.report", "record": map[string]any{"metrics": map[string]any{"durationMs": 1.5}}, "lambda": lambda, "axiom": meta},
+		// a per-event copy must not be served from the cache
+		{"type": "platform.runtimeDone", "lambda": map[string]any{"name": "fn", "outcome": "timeout"}, "axiom": meta},
+		{"time": nil, "lambda": "not a map", "n": 42, "list": []string{"x"}},
+	}
+
+	var want bytes.Buffer
+	enc := json.NewEncoder(&want)
+	for _, e := range batch {
+		if err := enc.Encode(e); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+
+	var got bytes.Buffer
+	if err := writeNDJSON(&got, batch); err != nil {
+		t.Fatalf("writeNDJSON: %v", err)
+	}
+	if got.String() != want.String() {
+		t.Fatalf("encodings differ:\ngot  %s\nwant %s", got.String(), want.String())
+	}
+}
+
+func BenchmarkEncodeBatch(b *testing.B) {
+	lambda := map[string]any{
+		"initializationType": "on-demand", "region": "eu-west-1", "name": "fn",
+		"memorySizeMB": int64(128), "version": "$LATEST",
+	}
+	meta := map[string]any{"awsLambdaExtensionVersion": "v1", "droppedByLambda": int64(0), "droppedByLambdaBytes": int64(0)}
+	batch := make([]axiom.Event, batchSize)
+	for i := range batch {
+		batch[i] = axiom.Event{
+			"_time":   "2024-01-16T08:53:51.000Z",
+			"type":    "function",
+			"message": fmt.Sprintf("log line %d with some text", i),
+			"record":  map[string]any{"requestId": "4b995efa-75f8-4fdc-92af-0882c79f47a1", "level": "INFO"},
+			"lambda":  lambda,
+			"axiom":   meta,
+		}
+	}
+
+	for _, algo := range []string{compressionGzip, compressionZstd, compressionNone} {
+		b.Run(algo, func(b *testing.B) {
+			prev := compression
+			compression = algo
+			defer func() { compression = prev }()
+
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, _, err := encodeBatch(batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package flusher
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/axiomhq/axiom-go/axiom"
+	"github.com/axiomhq/axiom-go/axiom/ingest"
+	"github.com/klauspost/compress/zstd"
+)
+
+// writerIngester writes the NDJSON events of every ingest to w instead of
+// sending them to Axiom. It decodes the exact body the real client would send,
+// so what it prints is what would have been ingested.
+type writerIngester struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriter returns an Axiom flusher whose flushes write the events as NDJSON
+// to w rather than ingesting them. It is meant for local debugging, such as
+// replaying recorded Telemetry API payloads.
+func NewWriter(w io.Writer) *Axiom {
+	ing := &writerIngester{w: w}
+	return &Axiom{
+		client:      ing,
+		retryClient: ing,
+		events:      make([]axiom.Event, 0),
+	}
+}
+
+func (wi *writerIngester) Ingest(_ context.Context, _ string, r io.Reader, _ axiom.ContentType, enc axiom.ContentEncoding, _ ...ingest.Option) (*ingest.Status, error) {
+	switch enc {
+	case axiom.Gzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case axiom.Zstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	wi.mu.Lock()
+	defer wi.mu.Unlock()
+
+	if _, err := io.Copy(wi.w, r); err != nil {
+		return nil, err
+	}
+	return &ingest.Status{}, nil
+}
@@ -5,6 +5,7 @@ go 1.24.0
 require (
 	github.com/axiomhq/axiom-go v0.29.0
 	github.com/axiomhq/pkg v0.6.0
+	github.com/klauspost/compress v1.18.4
 	github.com/peterbourgon/ff/v2 v2.0.1
 	go.uber.org/zap v1.27.1
 )
@@ -16,7 +17,6 @@ require (
 	github.com/go-logr/logr v1.4.3 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/google/go-querystring v1.2.0 // indirect
-	github.com/klauspost/compress v1.18.4 // indirect
 	go.opentelemetry.io/auto/sdk v1.2.1 // indirect
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.65.0 // indirect
 	go.opentelemetry.io/otel v1.40.0 // indirect
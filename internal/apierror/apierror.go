@@ -0,0 +1,32 @@
+// Package apierror types the failures of the Lambda runtime APIs the extension
+// calls, so that the Extensions and Telemetry API clients share one retry
+// policy.
+package apierror
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// StatusError is returned when a runtime API responds with an unexpected
+// status.
+type StatusError struct {
+	Op         string
+	StatusCode int
+	Status     string
+	// Body is the response body, if the API explained the status.
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body != "" {
+		return fmt.Sprintf("%s request failed with status %s: %s", e.Op, e.Status, e.Body)
+	}
+	return fmt.Sprintf("%s request failed with status %s", e.Op, e.Status)
+}
+
+// Retryable reports whether the request may succeed when repeated: server
+// errors and throttling may pass, a rejected request won't.
+func (e *StatusError) Retryable() bool {
+	return e.StatusCode >= http.StatusInternalServerError || e.StatusCode == http.StatusTooManyRequests
+}
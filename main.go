@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -29,6 +31,13 @@ var (
 	// API Port
 	logsPort = "8080"
 
+	// telemetryProtocol is how the Telemetry API delivers events: "http" posts
+	// batches to logsPort, "tcp" streams newline-delimited JSON to tcpPort,
+	// saving the HTTP overhead on high-volume functions. Override with
+	// AXIOM_TELEMETRY_PROTOCOL.
+	telemetryProtocol        = protocolHTTP
+	tcpPort           uint16 = 8081
+
 	// Buffering Config
 	defaultMaxItems  uint32 = 1000
 	defaultMaxBytes  uint32 = 262144
@@ -48,6 +57,11 @@ var (
 
 	developmentMode = false
 	logger          *zap.Logger
+
+	// configErrors collects the invalid settings found in init, for the
+	// validate subcommand. The server and flusher packages collect theirs the
+	// same way and report them through their ValidateConfig.
+	configErrors []error
 )
 
 func init() {
@@ -59,6 +73,49 @@ func init() {
 		} else {
 			logger.Warn("invalid AXIOM_FLUSH_TIMEOUT, using default",
 				zap.String("value", v), zap.Duration("default", flushTimeout))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_FLUSH_TIMEOUT %q", v))
+		}
+	}
+
+	if v := os.Getenv("AXIOM_API_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			apiTimeout = d
+		} else {
+			logger.Warn("invalid AXIOM_API_TIMEOUT, using default",
+				zap.String("value", v), zap.Duration("default", apiTimeout))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_API_TIMEOUT %q", v))
+		}
+	}
+
+	if v := os.Getenv("AXIOM_API_RETRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			apiRetries = n
+		} else {
+			logger.Warn("invalid AXIOM_API_RETRIES, using default",
+				zap.String("value", v), zap.Int("default", apiRetries))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_API_RETRIES %q", v))
+		}
+	}
+
+	if v := os.Getenv("AXIOM_TELEMETRY_PROTOCOL"); v != "" {
+		switch v {
+		case protocolHTTP, protocolTCP:
+			telemetryProtocol = v
+		default:
+			logger.Warn("invalid AXIOM_TELEMETRY_PROTOCOL, using default",
+				zap.String("value", v), zap.String("default", telemetryProtocol))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_TELEMETRY_PROTOCOL %q", v))
+		}
+	}
+
+	if v := os.Getenv("AXIOM_TELEMETRY_API"); v != "" {
+		switch v {
+		case telemetryAPIAuto, telemetryAPITelemetry, telemetryAPILogs:
+			telemetryAPI = v
+		default:
+			logger.Warn("invalid AXIOM_TELEMETRY_API, using default",
+				zap.String("value", v), zap.String("default", telemetryAPI))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_TELEMETRY_API %q", v))
 		}
 	}
 }
@@ -71,12 +128,21 @@ func main() {
 		Exec: func(ctx context.Context, args []string) error {
 			return Run()
 		},
+		Subcommands: []*ffcli.Command{
+			replayCommand(),
+			validateCommand(),
+		},
 	}
 
 	rootCmd.FlagSet.BoolVar(&developmentMode, "development-mode", false, "Set development Mode")
 
 	if err := rootCmd.ParseAndRun(context.Background(), os.Args[1:]); err != nil && err != flag.ErrHelp {
 		fmt.Fprintln(os.Stderr, err)
+		// Only validate exits non-zero: failing the extension would fail the
+		// function with it.
+		if errors.Is(err, errInvalidConfig) {
+			os.Exit(1)
+		}
 	}
 }
 
@@ -107,35 +173,53 @@ func Run() error {
 
 	// Extension API REGISTRATION on startup
 	extensionClient = extension.New(runtimeAPI)
+	extensionClient.Timeout = apiTimeout
 
-	_, err = extensionClient.Register(ctx, extensionName)
+	err = withRetry(ctx, "register", func(ctx context.Context) error {
+		_, registerErr := extensionClient.Register(ctx, extensionName)
+		return registerErr
+	})
 	if err != nil {
 		return err
 	}
 
 	// LOGS API SUBSCRIPTION
 	telemetryClient := telemetryapi.New(runtimeAPI)
+	telemetryClient.Timeout = apiTimeout
 
 	destination := telemetryapi.Destination{
 		Protocol:   "HTTP",
-		URI:        telemetryapi.URI(fmt.Sprintf("http://sandbox.localdomain:%s/", logsPort)),
+		URI:        telemetryapi.URI(fmt.Sprintf("http://sandbox.localdomain:%s%s", logsPort, server.TelemetryPath)),
 		HttpMethod: "POST",
 		Encoding:   "JSON",
 	}
-
-	bufferingCfg := telemetryapi.BufferingCfg{
-		MaxItems:  defaultMaxItems,
-		MaxBytes:  defaultMaxBytes,
-		TimeoutMS: defaultTimeoutMS,
+	if telemetryProtocol == protocolTCP {
+		if listenErr := httpServer.ListenTCP(ctx, tcpPort); listenErr != nil {
+			logger.Error("Failed to listen on TCP, subscribing over HTTP", zap.Error(listenErr))
+		} else {
+			destination = telemetryapi.Destination{
+				Protocol: telemetryapi.TCPProto,
+				Port:     tcpPort,
+				Encoding: "JSON",
+			}
+		}
 	}
 
-	_, err = telemetryClient.Subscribe(ctx, []string{"function", "platform"}, bufferingCfg, destination, extensionClient.ExtensionID)
+	bufferingCfg := defaultBufferingCfg()
+
+	err = subscribe(ctx, telemetryClient, []string{"function", "platform"}, bufferingCfg, destination, extensionClient.ExtensionID)
 	if err != nil {
 		return err
 	}
+	httpServer.Subscribed()
 
 	// Make sure we flush with retry on exit, bounded so shutdown can't hang.
+	// On SHUTDOWN, shutdown has already used the time there is.
+	shutDown := false
 	defer func() {
+		if shutDown {
+			return
+		}
 		flusher.SafelyUseAxiomClient(axiom, func(client *flusher.Axiom) {
 			shutdownCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
 			defer cancel()
@@ -149,12 +233,27 @@ func Run() error {
 			logger.Info("Context done", zap.Error(ctx.Err()))
 			return nil
 		default:
-			res, err := extensionClient.NextEvent(ctx, extensionName)
+			// A dropped connection to the Extensions API is reconnected; an
+			// error it answers with, such as an unknown extension ID, is final.
+			var res *extension.NextEventResponse
+			err := withRetry(ctx, "next event", func(ctx context.Context) error {
+				var nextErr error
+				res, nextErr = extensionClient.NextEvent(ctx, extensionName)
+				return nextErr
+			})
 			if err != nil {
+				if ctx.Err() != nil {
+					logger.Info("Context done", zap.Error(ctx.Err()))
+					return nil
+				}
 				logger.Error("Next event failed:", zap.Error(err))
 				return err
 			}
 
+			if res.EventType == extension.Invoke {
+				httpServer.Invoked(res)
+			}
+
 			// On every event received, check if we should flush. The flush is
 			// bounded by the invocation deadline so a slow or stalled ingest can
 			// never hold the sandbox open until the function times out (issue #48).
@@ -167,9 +266,10 @@ func Run() error {
 			})
 			cancel()
 
-			// Wait for the first invocation to finish (receive platform.runtimeDone log), then flush
-			if isFirstInvocation {
-				<-runtimeDone
+			// Wait for the first invocation to finish (receive platform.runtimeDone log), then flush.
+			// A sandbox can also be shut down before it was ever invoked.
+			if isFirstInvocation && res.EventType == extension.Invoke {
+				waitForRuntimeDone(ctx, res.DeadlineMs)
 				isFirstInvocation = false
 				flushCtx, cancel := flushContext(ctx, res.DeadlineMs)
 				flusher.SafelyUseAxiomClient(axiom, func(client *flusher.Axiom) {
@@ -179,14 +279,42 @@ func Run() error {
 				cancel()
 			}
 
-			if res.EventType == "SHUTDOWN" {
-				_ = httpServer.Shutdown()
+			if res.EventType == extension.Shutdown {
+				shutdown(httpServer, axiom, res)
+				shutDown = true
 				return nil
 			}
 		}
 	}
 }
 
+func defaultBufferingCfg() telemetryapi.BufferingCfg {
+	return telemetryapi.BufferingCfg{
+		MaxItems:  defaultMaxItems,
+		MaxBytes:  defaultMaxBytes,
+		TimeoutMS: defaultTimeoutMS,
+	}
+}
+
+// waitForRuntimeDone waits for the first invocation's platform.runtimeDone,
+// but no longer than the invocation's deadline minus flushSafetyMargin: the
+// event may never arrive, e.g. when its batch was lost, and waiting on would
+// hold the sandbox open until the function times out (issue #48).
+func waitForRuntimeDone(ctx context.Context, deadlineMs int64) {
+	var timeout <-chan time.Time
+	if deadlineMs > 0 {
+		timer := time.NewTimer(time.Until(time.UnixMilli(deadlineMs).Add(-flushSafetyMargin)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-runtimeDone:
+	case <-ctx.Done():
+	case <-timeout:
+		logger.Warn("platform.runtimeDone not received before the invocation deadline")
+	}
+}
+
 // flushContext derives a context for a single flush. The flush is bounded by both
 // flushTimeout and the current invocation's deadline (minus flushSafetyMargin) so
 // that a slow or stalled ingest is abandoned in time for the extension to call
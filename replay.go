@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+
+	"github.com/axiomhq/axiom-lambda-extension/flusher"
+	"github.com/axiomhq/axiom-lambda-extension/server"
+)
+
+func replayCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	send := fs.Bool("send", false, "Send the events to the configured Axiom dataset instead of printing them")
+
+	return &ffcli.Command{
+		Name:       "replay",
+		ShortUsage: "axiom-lambda-extension replay [flags] [file ...]",
+		ShortHelp:  "replay recorded Telemetry API payloads",
+		LongHelp: "Replay reads Telemetry API batches (JSON arrays of events, as Lambda posts them, " +
+			"or capture files written with AXIOM_CAPTURE=true) from the given files, or from stdin " +
+			"when no file or \"-\" is given, and runs them through " +
+			"the same parsing and enrichment as the extension. The resulting events are printed as " +
+			"NDJSON, or ingested into the configured dataset with -send.",
+		FlagSet: fs,
+		Exec: func(ctx context.Context, args []string) error {
+			return Replay(ctx, args, *send)
+		},
+	}
+}
+
+// Replay feeds recorded Telemetry API batches through the Telemetry API handler.
+func Replay(ctx context.Context, paths []string, send bool) error {
+	var ax *flusher.Axiom
+	if send {
+		var err error
+		if ax, err = flusher.New(); err != nil {
+			return err
+		}
+	} else {
+		ax = flusher.NewWriter(os.Stdout)
+	}
+
+	handler := server.Handler(ax)
+
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	for _, path := range paths {
+		if err := replayFile(ctx, handler, ax, path); err != nil {
+			return fmt.Errorf("replaying %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// replayFile replays every batch in a file. Batches may be concatenated or one
+// per line, either bare or as written by the server's capture mode.
+func replayFile(ctx context.Context, handler http.Handler, ax *flusher.Axiom, path string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path) //nolint:gosec // reading the files the user asked to replay is the point
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		var batch json.RawMessage
+		if err := dec.Decode(&batch); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Lines written by capture mode wrap the batch with request metadata.
+		if trimmed := bytes.TrimSpace(batch); len(trimmed) > 0 && trimmed[0] == '{' {
+			var rec server.CaptureRecord
+			if err := json.Unmarshal(batch, &rec); err != nil {
+				return err
+			}
+			payload, err := rec.Payload()
+			if err != nil {
+				return err
+			}
+			batch = payload
+		}
+
+		if err := replayBatch(handler, batch); err != nil {
+			return err
+		}
+		ax.Flush(ctx, flusher.Retry)
+	}
+}
+
+// replayBatch posts a batch to the handler the way the Telemetry API would.
+func replayBatch(handler http.Handler, batch []byte) error {
+	req, err := http.NewRequest(http.MethodPost, "/", bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	res := &batchResponse{header: http.Header{}, status: http.StatusOK}
+	handler.ServeHTTP(res, req)
+
+	if res.status >= http.StatusMultipleChoices {
+		return fmt.Errorf("handler rejected batch with status %d: %s", res.status, res.body.String())
+	}
+	return nil
+}
+
+// batchResponse is what the handler answers to a replayed batch.
+type batchResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *batchResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *batchResponse) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+}
+
+func (r *batchResponse) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.body.Write(p)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/axiomhq/axiom-lambda-extension/internal/apierror"
+)
+
+var (
+	// apiTimeout bounds each Extensions and Telemetry API request except
+	// NextEvent. Override with AXIOM_API_TIMEOUT (a Go duration).
+	apiTimeout = 5 * time.Second
+
+	// apiRetries is how many times an Extensions or Telemetry API call is
+	// attempted before the extension gives up. Override with AXIOM_API_RETRIES.
+	apiRetries = 5
+
+	apiInitialBackoff = 100 * time.Millisecond
+	apiMaxBackoff     = 2 * time.Second
+)
+
+// withRetry calls fn until it succeeds, fails with an error that retrying
+// won't fix, apiRetries attempts were made or ctx is done. Attempts are spaced
+// by an exponential backoff with jitter.
+func withRetry(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	backoff := apiInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !retryable(ctx, err) || attempt >= apiRetries {
+			return err
+		}
+
+		wait := backoff/2 + rand.N(backoff/2+1) //nolint:gosec // jitter needs no cryptographic randomness
+		logger.Warn("API call failed, retrying",
+			zap.String("op", op), zap.Int("attempt", attempt), zap.Duration("backoff", wait), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, apiMaxBackoff)
+	}
+}
+
+// retryable reports whether a failed API call is worth repeating. Both API
+// clients report unexpected statuses as an apierror.StatusError, which tells;
+// anything else, such as a refused connection or a timed out request, is a
+// blip, unless the extension itself is stopping.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusErr *apierror.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Retryable()
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axiomhq/axiom-lambda-extension/extension"
+)
+
+// fastRetries makes withRetry back off for microseconds and attempt n times.
+func fastRetries(t *testing.T, n int) {
+	t.Helper()
+	prevRetries, prevInitial, prevMax := apiRetries, apiInitialBackoff, apiMaxBackoff
+	apiRetries, apiInitialBackoff, apiMaxBackoff = n, time.Microsecond, 10*time.Microsecond
+	t.Cleanup(func() { apiRetries, apiInitialBackoff, apiMaxBackoff = prevRetries, prevInitial, prevMax })
+}
+
+func TestWithRetryGivesUpAfterTheLastAttempt(t *testing.T) {
+	fastRetries(t, 3)
+
+	calls := 0
+	err := withRetry(context.Background(), "test", func(context.Context) error {
+		calls++
+		return errors.New("connection refused")
+	})
+	if err == nil || calls != 3 {
+		t.Fatalf("expected 3 attempts and the last error, got %d attempts and %v", calls, err)
+	}
+}
+
+func TestWithRetryStopsAtANonRetryableStatus(t *testing.T) {
+	fastRetries(t, 5)
+
+	calls := 0
+	err := withRetry(context.Background(), "test", func(context.Context) error {
+		calls++
+		return &extension.StatusError{Op: "register", StatusCode: http.StatusForbidden, Status: "403 Forbidden"}
+	})
+	var statusErr *extension.StatusError
+	if !errors.As(err, &statusErr) || calls != 1 {
+		t.Fatalf("expected one attempt and the status error, got %d attempts and %v", calls, err)
+	}
+}
+
+func TestWithRetryStopsWhenTheContextIsDone(t *testing.T) {
+	fastRetries(t, 5)
+	apiInitialBackoff, apiMaxBackoff = time.Hour, time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	done := make(chan error)
+	go func() {
+		done <- withRetry(ctx, "test", func(context.Context) error {
+			calls++
+			return errors.New("connection refused")
+		})
+	}()
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	select {
+	case err := <-done:
+		if err == nil || calls != 1 {
+			t.Fatalf("expected the backoff to end with the context, got %d attempts and %v", calls, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("withRetry did not return after the context was cancelled")
+	}
+
+	if retryable(ctx, errors.New("connection refused")) {
+		t.Fatal("expected nothing to be retryable once the context is done")
+	}
+}
+
+func TestNextEventReconnectsAfterServerErrors(t *testing.T) {
+	fastRetries(t, 5)
+
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if failures > 0 {
+			failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"eventType":"INVOKE","requestId":"req-1"}`))
+	}))
+	defer srv.Close()
+
+	client := extension.New(strings.TrimPrefix(srv.URL, "http://"))
+	var res *extension.NextEventResponse
+	err := withRetry(context.Background(), "next event", func(ctx context.Context) error {
+		var nextErr error
+		res, nextErr = client.NextEvent(ctx, "test")
+		return nextErr
+	})
+	if err != nil || res.RequestID != "req-1" {
+		t.Fatalf("expected the next event after reconnecting, got %+v and %v", res, err)
+	}
+}
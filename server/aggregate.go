@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/axiomhq/axiom-go/axiom"
+	"go.uber.org/zap"
+
+	"github.com/axiomhq/axiom-lambda-extension/telemetryapi"
+)
+
+// aggregateMode controls whether a request's events are summarised into a
+// single wide event when its platform.report arrives.
+type aggregateMode string
+
+const (
+	// aggregateOff ships every event as is.
+	aggregateOff aggregateMode = "off"
+	// aggregateAlongside ships the summary in addition to every event.
+	aggregateAlongside aggregateMode = "alongside"
+	// aggregateOnly ships the summary instead of the request's function log
+	// lines. Platform events and lines that can't be attributed to a request
+	// are still shipped individually.
+	aggregateOnly aggregateMode = "only"
+
+	eventTypeInvocation = "axiom.invocation"
+)
+
+var (
+	// aggregate is set with AXIOM_AGGREGATE.
+	aggregate = aggregateOff
+
+	// aggregateMaxLines caps how many log lines a summary keeps (the first
+	// ones); the remaining lines are still counted. Override with
+	// AXIOM_AGGREGATE_MAX_LINES.
+	aggregateMaxLines = 50
+
+	// aggregateMaxLineBytes truncates the lines kept in a summary, which bounds
+	// the memory held per in-flight request.
+	aggregateMaxLineBytes = 2048
+)
+
+// loadAggregateConfig reads the aggregation mode and AXIOM_AGGREGATE_MAX_LINES.
+func loadAggregateConfig() {
+	if v := os.Getenv("AXIOM_AGGREGATE"); v != "" {
+		switch mode := aggregateMode(strings.ToLower(v)); mode {
+		case aggregateOff, aggregateAlongside, aggregateOnly:
+			aggregate = mode
+		default:
+			logger.Warn("invalid AXIOM_AGGREGATE, using default",
+				zap.String("value", v), zap.String("default", string(aggregate)))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_AGGREGATE %q", v))
+		}
+	}
+
+	if v := os.Getenv("AXIOM_AGGREGATE_MAX_LINES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			aggregateMaxLines = n
+		} else {
+			logger.Warn("invalid AXIOM_AGGREGATE_MAX_LINES, using default",
+				zap.String("value", v), zap.Int("default", aggregateMaxLines))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_AGGREGATE_MAX_LINES %q", v))
+		}
+	}
+}
+
+// levelRank orders log levels by severity; unknown levels rank lowest.
+var levelRank = map[string]int{
+	"trace":    1,
+	"debug":    2,
+	"info":     3,
+	"warn":     4,
+	"warning":  4,
+	"error":    5,
+	"fatal":    6,
+	"critical": 6,
+}
+
+// summary accumulates what a request's wide event reports about its logs.
+type summary struct {
+	logCount       int
+	errorCount     int
+	level          string
+	firstError     string
+	lines          []string
+	linesTruncated bool
+}
+
+func (s *summary) observe(level, message string) {
+	s.logCount++
+	if levelRank[level] > levelRank[s.level] {
+		s.level = level
+	}
+	if levelRank[level] >= levelRank["error"] {
+		s.errorCount++
+		if s.firstError == "" {
+			s.firstError = truncate(message, aggregateMaxLineBytes)
+		}
+	}
+	if len(s.lines) < aggregateMaxLines {
+		s.lines = append(s.lines, truncate(message, aggregateMaxLineBytes))
+	} else {
+		s.linesTruncated = true
+	}
+}
+
+// invocationEvent builds the wide event summarising a request. report is nil
+// for requests evicted before their platform.report arrived.
+func invocationEvent(inv invocation, report *telemetryapi.ReportRecord) axiom.Event {
+	details := map[string]any{
+		"logCount":       inv.summary.logCount,
+		"errorCount":     inv.summary.errorCount,
+		"lines":          inv.summary.lines,
+		"linesTruncated": inv.summary.linesTruncated,
+	}
+	if inv.summary.level != "" {
+		details["level"] = inv.summary.level
+	}
+	if inv.summary.firstError != "" {
+		details["firstError"] = inv.summary.firstError
+	}
+	if report != nil {
+		details["status"] = report.Status
+		details["metrics"] = report.Metrics
+		if report.ErrorType != "" {
+			details["errorType"] = report.ErrorType
+		}
+	} else {
+		details["incomplete"] = true
+	}
+
+	e := axiom.Event{
+		"_time":        inv.startTime.UTC().Format(time.RFC3339Nano),
+		fieldType:      eventTypeInvocation,
+		fieldRequestID: inv.requestID,
+		"invocation":   details,
+		"lambda":       inv.taggedLambdaMeta(versionedLambdaMeta()),
+	}
+	if inv.traceID != "" {
+		e["traceId"] = inv.traceID
+	}
+	if inv.functionArn != "" {
+		e["invokedFunctionArn"] = inv.functionArn
+	}
+	if inv.tenantID != "" {
+		e[fieldTenantID] = inv.tenantID
+	}
+	return e
+}
+
+// eventLevel returns the normalized level of a log event, if it has one.
+func eventLevel(e axiom.Event) string {
+	if level, ok := e["level"].(string); ok {
+		return strings.ToLower(level)
+	}
+	if record, ok := e[fieldRecord].(map[string]any); ok {
+		if level, ok := stringField(record, "level"); ok {
+			return strings.ToLower(level)
+		}
+	}
+	return ""
+}
+
+// eventMessage returns the message of a log event as text, preferring the
+// message parsed out of the record over the raw line.
+func eventMessage(e axiom.Event) string {
+	if record, ok := e[fieldRecord].(map[string]any); ok {
+		if msg, ok := stringField(record, "message"); ok {
+			return msg
+		}
+	}
+	switch msg := e["message"].(type) {
+	case string:
+		return msg
+	case nil:
+		return ""
+	default:
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
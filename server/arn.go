@@ -0,0 +1,79 @@
+package server
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// functionArn is what an invoked function ARN,
+// arn:<partition>:lambda:<region>:<account>:function:<name>[:<qualifier>],
+// tells about an invocation.
+type functionArn struct {
+	partition string
+	accountID string
+	// qualifier is the alias or version the function was invoked with, if
+	// any.
+	qualifier string
+}
+
+func parseFunctionArn(arn string) (functionArn, bool) {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 7 || len(parts) > 8 || parts[0] != "arn" || parts[2] != "lambda" || parts[5] != "function" {
+		return functionArn{}, false
+	}
+	parsed := functionArn{partition: parts[1], accountID: parts[4]}
+	if len(parts) == 8 {
+		parsed.qualifier = parts[7]
+	}
+	return parsed, true
+}
+
+// addTo adds the ARN's details to lambda metadata. A qualifier that is a
+// version is reported as such, anything else is an alias.
+func (a functionArn) addTo(meta map[string]any) {
+	meta["partition"] = a.partition
+	meta["accountId"] = a.accountID
+	switch {
+	case a.qualifier == "":
+	case a.qualifier == "$LATEST" || isVersion(a.qualifier):
+		meta["invokedVersion"] = a.qualifier
+	default:
+		meta["alias"] = a.qualifier
+	}
+}
+
+func isVersion(qualifier string) bool {
+	_, err := strconv.ParseUint(qualifier, 10, 64)
+	return err == nil
+}
+
+// architecture returns the instruction set architecture as Lambda names it.
+func architecture() string {
+	if runtime.GOARCH == "amd64" {
+		return "x86_64"
+	}
+	return runtime.GOARCH
+}
+
+// lambdaMeta returns the lambda metadata for the invocation's events: the
+// sandbox's base metadata, at generation gen, plus what the invoked ARN tells.
+// The result is cached, so that the invocation's events share one map, until
+// the generation changes.
+func (inv *invocation) lambdaMeta(base map[string]any, gen uint64) map[string]any {
+	if inv.meta != nil && inv.metaGen == gen {
+		return inv.meta
+	}
+
+	meta := base
+	if arn, ok := parseFunctionArn(inv.functionArn); ok {
+		meta = make(map[string]any, len(base)+3)
+		for k, v := range base {
+			meta[k] = v
+		}
+		arn.addTo(meta)
+	}
+	// the tagged metadata was built from the previous map
+	inv.meta, inv.metaGen, inv.tagged = meta, gen, nil
+	return meta
+}
@@ -0,0 +1,60 @@
+package server
+
+import "testing"
+
+func TestParseFunctionArn(t *testing.T) {
+	for arn, want := range map[string]map[string]any{
+		"arn:aws:lambda:eu-west-1:123456789012:function:fn:live":    {"partition": "aws", "accountId": "123456789012", "alias": "live"},
+		"arn:aws-cn:lambda:cn-north-1:123456789012:function:fn:7":   {"partition": "aws-cn", "accountId": "123456789012", "invokedVersion": "7"},
+		"arn:aws:lambda:eu-west-1:123456789012:function:fn:$LATEST": {"partition": "aws", "accountId": "123456789012", "invokedVersion": "$LATEST"},
+		"arn:aws:lambda:eu-west-1:123456789012:function:fn":         {"partition": "aws", "accountId": "123456789012"},
+	} {
+		parsed, ok := parseFunctionArn(arn)
+		if !ok {
+			t.Fatalf("expected %s to parse", arn)
+		}
+		meta := map[string]any{}
+		parsed.addTo(meta)
+		if len(meta) != len(want) {
+			t.Fatalf("%s: expected %v, got %v", arn, want, meta)
+		}
+		for k, v := range want {
+			assertEqual(t, meta[k], v)
+		}
+	}
+
+	for _, arn := range []string{"", "arn:aws:s3:::bucket", "arn:aws:lambda:eu-west-1:123456789012:layer:l:1"} {
+		if _, ok := parseFunctionArn(arn); ok {
+			t.Errorf("expected %q not to parse", arn)
+		}
+	}
+}
+
+func TestInvocationLambdaMetaIsSharedPerRequest(t *testing.T) {
+	s := newInvocations()
+	s.invoked("req-1", "", "arn:aws:lambda:eu-west-1:123456789012:function:fn:live")
+
+	first := s.lambdaMeta("req-1")
+	assertEqual(t, first["alias"], "live")
+	assertEqual(t, first["accountId"], "123456789012")
+
+	second := s.lambdaMeta("req-1")
+	second["marker"] = true
+	if first["marker"] != true {
+		t.Fatal("expected the request's events to share one metadata map")
+	}
+
+	if _, ok := s.lambdaMeta("other")["alias"]; ok {
+		t.Fatal("expected untracked requests to get the sandbox's metadata")
+	}
+	if _, ok := lambdaMeta()["alias"]; ok {
+		t.Fatal("expected the sandbox's metadata to stay untouched")
+	}
+
+	prev := lambdaMeta()
+	defer func() { lambdaMetaInfo = prev }()
+	updateLambdaMeta(func(meta map[string]any) { meta["restoreDurationMs"] = 42.0 })
+	refreshed := s.lambdaMeta("req-1")
+	assertEqual(t, refreshed["restoreDurationMs"], 42.0)
+	assertEqual(t, refreshed["alias"], "live")
+}
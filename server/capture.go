@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Capture mode records every Telemetry API request body, as received, so that
+// parsing bugs can be reproduced offline with the replay subcommand. Over TCP
+// every batch of lines is recorded as the JSON array it would have been posted
+// as. It is enabled with AXIOM_CAPTURE=true and writes to AXIOM_CAPTURE_PATH,
+// rotating to AXIOM_CAPTURE_PATH.1 whenever the file would exceed
+// AXIOM_CAPTURE_MAX_BYTES (so at most twice that is kept on disk).
+// AXIOM_CAPTURE_REDACT is a comma-separated list of regular expressions whose
+// matches in bodies and header values are replaced by [REDACTED] before
+// anything is written.
+var (
+	captureEnabled  = false
+	capturePath     = "/tmp/axiom-telemetry-capture.ndjson"
+	captureMaxBytes = int64(10 << 20)
+	captureRedact   []*regexp.Regexp
+
+	capturer *capture
+)
+
+const redacted = "[REDACTED]"
+
+// loadCaptureConfig reads the AXIOM_CAPTURE settings. An invalid redaction
+// expression disables capture rather than capturing unredacted.
+func loadCaptureConfig() {
+	if v := os.Getenv("AXIOM_CAPTURE"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			captureEnabled = b
+		} else {
+			logger.Warn("invalid AXIOM_CAPTURE, using default",
+				zap.String("value", v), zap.Bool("default", captureEnabled))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_CAPTURE %q", v))
+		}
+	}
+
+	if v := os.Getenv("AXIOM_CAPTURE_PATH"); v != "" {
+		capturePath = v
+	}
+
+	if v := os.Getenv("AXIOM_CAPTURE_MAX_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			captureMaxBytes = n
+		} else {
+			logger.Warn("invalid AXIOM_CAPTURE_MAX_BYTES, using default",
+				zap.String("value", v), zap.Int64("default", captureMaxBytes))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_CAPTURE_MAX_BYTES %q", v))
+		}
+	}
+
+	if v := os.Getenv("AXIOM_CAPTURE_REDACT"); v != "" {
+		for _, expr := range strings.Split(v, ",") {
+			rgx, err := regexp.Compile(strings.TrimSpace(expr))
+			if err != nil {
+				// Capturing without a redaction the user asked for could leak
+				// what they meant to hide, so capture is disabled instead.
+				logger.Warn("invalid AXIOM_CAPTURE_REDACT expression, capture disabled",
+					zap.String("value", expr), zap.Error(err))
+				configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_CAPTURE_REDACT expression %q: %w", expr, err))
+				captureEnabled = false
+				break
+			}
+			captureRedact = append(captureRedact, rgx)
+		}
+	}
+
+	if captureEnabled {
+		capturer = &capture{path: capturePath, maxBytes: captureMaxBytes, redact: captureRedact}
+	}
+}
+
+// CaptureRecord is one captured Telemetry API request, written as one line of
+// NDJSON. Body holds the request body as JSON, or as a JSON string when the body
+// (or its redacted form) isn't valid JSON.
+type CaptureRecord struct {
+	Time    time.Time         `json:"time"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+// Payload returns the request body of a captured request.
+func (r *CaptureRecord) Payload() ([]byte, error) {
+	if len(r.Body) > 0 && r.Body[0] == '"' {
+		var s string
+		if err := json.Unmarshal(r.Body, &s); err != nil {
+			return nil, err
+		}
+		return []byte(s), nil
+	}
+	return r.Body, nil
+}
+
+// capture appends captured requests to a size-capped, rotating file. The file
+// is opened lazily, so enabling capture costs nothing until data arrives.
+type capture struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	redact   []*regexp.Regexp
+	f        *os.File
+	size     int64
+	failed   bool
+}
+
+// record captures a request body. r is nil for what arrived over TCP, which
+// has no headers.
+func (c *capture) record(r *http.Request, body []byte) {
+	rec := CaptureRecord{Time: time.Now().UTC()}
+	if r != nil {
+		rec.Headers = make(map[string]string, len(r.Header))
+		for k := range r.Header {
+			rec.Headers[k] = c.redactString(r.Header.Get(k))
+		}
+	}
+	body = c.redactBytes(body)
+	if json.Valid(body) {
+		rec.Body = body
+	} else {
+		rec.Body, _ = json.Marshal(string(body))
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		logger.Error("Error encoding capture record:", zap.Error(err))
+		return
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.failed {
+		return
+	}
+	if err := c.write(line); err != nil {
+		// Give up for the lifetime of the sandbox rather than logging an error
+		// for every batch; capture is a debugging aid.
+		c.failed = true
+		logger.Error("Error writing capture file, capture disabled:", zap.String("path", c.path), zap.Error(err))
+	}
+}
+
+// write appends a line, rotating first if it would exceed maxBytes. Callers
+// must hold c.mu.
+func (c *capture) write(line []byte) error {
+	if c.f != nil && c.size+int64(len(line)) > c.maxBytes {
+		_ = c.f.Close()
+		c.f = nil
+		if err := os.Rename(c.path, c.path+".1"); err != nil {
+			return err
+		}
+	}
+
+	if c.f == nil {
+		f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600) //nolint:gosec // the path is configured by the function owner
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		c.f, c.size = f, info.Size()
+	}
+
+	n, err := c.f.Write(line)
+	c.size += int64(n)
+	return err
+}
+
+func (c *capture) redactBytes(b []byte) []byte {
+	for _, rgx := range c.redact {
+		b = rgx.ReplaceAll(b, []byte(redacted))
+	}
+	return b
+}
+
+func (c *capture) redactString(s string) string {
+	return string(c.redactBytes([]byte(s)))
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func readCaptureFile(t *testing.T, path string) []CaptureRecord {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open capture file: %v", err)
+	}
+	defer f.Close()
+
+	var records []CaptureRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec CaptureRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid capture line %q: %v", sc.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestCaptureRecordsRedactedBodies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.ndjson")
+	c := &capture{path: path, maxBytes: 1 << 20, redact: []*regexp.Regexp{regexp.MustCompile(`secret-\w+`)}}
+
+	body := `[{"type":"function","record":"token=secret-abc123"}]`
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("X-Test", "secret-header")
+	c.record(req, []byte(body))
+	c.record(req, []byte("not json"))
+
+	records := readCaptureFile(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 capture records, got %d", len(records))
+	}
+
+	payload, err := records[0].Payload()
+	if err != nil {
+		t.Fatalf("payload: %v", err)
+	}
+	assertEqual(t, string(payload), `[{"type":"function","record":"token=[REDACTED]"}]`)
+	assertEqual(t, records[0].Headers["X-Test"], redacted)
+
+	payload, err = records[1].Payload()
+	if err != nil {
+		t.Fatalf("payload: %v", err)
+	}
+	assertEqual(t, string(payload), "not json")
+}
+
+func TestCaptureRotatesAtSizeCap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.ndjson")
+	c := &capture{path: path, maxBytes: 200}
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	for i := 0; i < 5; i++ {
+		c.record(req, []byte(`[{"type":"function","record":"line"}]`))
+	}
+
+	for _, p := range []string{path, path + ".1"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("expected %s to exist: %v", p, err)
+		}
+		if info.Size() > 200 {
+			t.Fatalf("expected %s capped at 200 bytes, got %d", p, info.Size())
+		}
+	}
+	if got := len(readCaptureFile(t, path)) + len(readCaptureFile(t, path+".1")); got >= 5 {
+		t.Fatalf("expected older records to be rotated out, kept %d", got)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/axiomhq/axiom-go/axiom"
+	"go.uber.org/zap"
+)
+
+var (
+	// dedupWindow enables folding identical function log lines: a line that
+	// repeats the previous line of its request and level within the window is
+	// counted instead of forwarded. Lines are held until the run ends, at the
+	// latest until the first batch after the window has passed or, for lines
+	// of a request, its platform.runtimeDone. 0 disables deduplication. Set with
+	// AXIOM_DEDUP_WINDOW (a Go duration, e.g. "1s").
+	dedupWindow time.Duration
+
+	// dedupMaxEntries bounds the dedup table; when it is full the oldest run is
+	// emitted to make room. Override with AXIOM_DEDUP_MAX_ENTRIES.
+	dedupMaxEntries = 1000
+)
+
+// loadDedupConfig reads AXIOM_DEDUP_WINDOW and AXIOM_DEDUP_MAX_ENTRIES.
+func loadDedupConfig() {
+	if v := os.Getenv("AXIOM_DEDUP_WINDOW"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			dedupWindow = d
+		} else {
+			logger.Warn("invalid AXIOM_DEDUP_WINDOW, using default",
+				zap.String("value", v), zap.Duration("default", dedupWindow))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_DEDUP_WINDOW %q", v))
+		}
+	}
+
+	if v := os.Getenv("AXIOM_DEDUP_MAX_ENTRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			dedupMaxEntries = n
+		} else {
+			logger.Warn("invalid AXIOM_DEDUP_MAX_ENTRIES, using default",
+				zap.String("value", v), zap.Int("default", dedupMaxEntries))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_DEDUP_MAX_ENTRIES %q", v))
+		}
+	}
+}
+
+// run is a line held by the dedup table together with the identical lines
+// that followed it.
+type run struct {
+	requestID string
+	message   string
+	event     axiom.Event
+	count     int
+	first     time.Time
+	lastTime  any
+}
+
+// emit returns the event forwarded for the run: its first line, annotated
+// with the number of lines folded into it when there was more than one. The
+// event hasn't been queued yet, so it may still be modified.
+func (r *run) emit() axiom.Event {
+	if r.count > 1 {
+		r.event["repeatCount"] = r.count
+		r.event["firstTime"] = r.event["_time"]
+		r.event["lastTime"] = r.lastTime
+	}
+	return r.event
+}
+
+// dedup folds runs of identical log lines per request and level. Each line is
+// held until it is known whether it repeats; the run is emitted when a
+// different line for the same key arrives, when its request is done, when the
+// window has passed or when the table needs room.
+type dedup struct {
+	mu   sync.Mutex
+	runs map[string]*run
+}
+
+func newDedup() *dedup {
+	return &dedup{runs: make(map[string]*run)}
+}
+
+// add offers a log line to the table, which holds it. It returns the events of
+// the runs that are complete as a result.
+func (d *dedup) add(e axiom.Event, requestID, level, message string, t time.Time) []axiom.Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := requestID + "\x00" + level
+	var out []axiom.Event
+	if r, ok := d.runs[key]; ok {
+		if r.message == message && t.Sub(r.first) < dedupWindow {
+			r.count++
+			r.lastTime = e["_time"]
+			return nil
+		}
+		delete(d.runs, key)
+		out = append(out, r.emit())
+	}
+
+	if len(d.runs) >= dedupMaxEntries {
+		out = append(out, d.evictOldest())
+	}
+	d.runs[key] = &run{
+		requestID: requestID,
+		message:   message,
+		event:     e,
+		count:     1,
+		first:     t,
+		lastTime:  e["_time"],
+	}
+	return out
+}
+
+// release returns the held runs of a request that is done.
+func (d *dedup) release(requestID string) []axiom.Event {
+	return d.emitWhere(func(r *run) bool { return r.requestID == requestID })
+}
+
+// expire returns the held runs whose window has passed.
+func (d *dedup) expire(now time.Time) []axiom.Event {
+	return d.emitWhere(func(r *run) bool { return now.Sub(r.first) >= dedupWindow })
+}
+
+func (d *dedup) emitWhere(match func(r *run) bool) []axiom.Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var done []*run
+	for key, r := range d.runs {
+		if match(r) {
+			delete(d.runs, key)
+			done = append(done, r)
+		}
+	}
+	// emit in the order the runs started, not the map's
+	slices.SortFunc(done, func(a, b *run) int { return a.first.Compare(b.first) })
+
+	out := make([]axiom.Event, 0, len(done))
+	for _, r := range done {
+		out = append(out, r.emit())
+	}
+	return out
+}
+
+// evictOldest emits the run that started first. Callers must hold d.mu.
+func (d *dedup) evictOldest() axiom.Event {
+	var oldestKey string
+	var oldest *run
+	for key, r := range d.runs {
+		if oldest == nil || r.first.Before(oldest.first) {
+			oldestKey, oldest = key, r
+		}
+	}
+	delete(d.runs, oldestKey)
+	return oldest.emit()
+}
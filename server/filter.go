@@ -0,0 +1,199 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/axiomhq/axiom-go/axiom"
+	"go.uber.org/zap"
+)
+
+// Filter operators.
+const (
+	opEqual      = "=="
+	opNotEqual   = "!="
+	opStartsWith = "startsWith"
+	opEndsWith   = "endsWith"
+	opContains   = "contains"
+	opIn         = "in"
+)
+
+var (
+	// includeFilters, when set, keep only the events matching one of them.
+	// Set with AXIOM_INCLUDE.
+	includeFilters []filter
+
+	// excludeFilters drop the events matching one of them. Set with
+	// AXIOM_EXCLUDE.
+	//
+	// Both take expressions separated by ";", each comparing a field path to a
+	// value, e.g. `type == "platform.start"; record.path startsWith "/health";
+	// level in [debug, trace]`. Quoted values may contain ";" and ",".
+	excludeFilters []filter
+)
+
+// loadFilterConfig reads AXIOM_INCLUDE and AXIOM_EXCLUDE. A list with an
+// invalid expression is ignored as a whole, so that it can't filter out more
+// than meant.
+func loadFilterConfig() {
+	for _, setting := range []struct {
+		name    string
+		filters *[]filter
+	}{
+		{"AXIOM_INCLUDE", &includeFilters},
+		{"AXIOM_EXCLUDE", &excludeFilters},
+	} {
+		v := os.Getenv(setting.name)
+		if v == "" {
+			continue
+		}
+		filters, err := parseFilters(v)
+		if err != nil {
+			logger.Warn("invalid "+setting.name+", not filtering", zap.String("value", v), zap.Error(err))
+			configErrors = append(configErrors, fmt.Errorf("invalid %s %q: %w", setting.name, v, err))
+			continue
+		}
+		*setting.filters = filters
+	}
+}
+
+// filter is a single comparison of an event field to one or more values.
+type filter struct {
+	path   string
+	op     string
+	values []string
+}
+
+func parseFilters(v string) ([]filter, error) {
+	var filters []filter
+	var errs []error
+	for _, expr := range splitUnquoted(v, ';') {
+		if expr = strings.TrimSpace(expr); expr == "" {
+			continue
+		}
+		f, err := parseFilter(expr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		filters = append(filters, f)
+	}
+	return filters, errors.Join(errs...)
+}
+
+// parseFilter parses `<path> <op> <value>`, where value is a bare word, a
+// quoted string or, for "in", a bracketed list of them.
+func parseFilter(expr string) (filter, error) {
+	path, rest, _ := strings.Cut(expr, " ")
+	op, value, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	value = strings.TrimSpace(value)
+	if path == "" || op == "" || value == "" {
+		return filter{}, fmt.Errorf("%q: expected <field> <operator> <value>", expr)
+	}
+
+	f := filter{path: path, op: op}
+	switch op {
+	case opEqual, opNotEqual, opStartsWith, opEndsWith, opContains:
+		lit, err := parseLiteral(value)
+		if err != nil {
+			return filter{}, fmt.Errorf("%q: %w", expr, err)
+		}
+		f.values = []string{lit}
+	case opIn:
+		if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+			return filter{}, fmt.Errorf("%q: expected a [list] after in", expr)
+		}
+		for _, item := range splitUnquoted(value[1:len(value)-1], ',') {
+			lit, err := parseLiteral(strings.TrimSpace(item))
+			if err != nil {
+				return filter{}, fmt.Errorf("%q: %w", expr, err)
+			}
+			f.values = append(f.values, lit)
+		}
+	default:
+		return filter{}, fmt.Errorf("%q: unknown operator %q", expr, op)
+	}
+	return f, nil
+}
+
+// splitUnquoted splits s around each sep that isn't inside a quoted string, so
+// that quoted values may contain it. An unterminated quote runs to the end of s
+// and is left to parseLiteral to reject.
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++ // skip the escaped character
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseLiteral(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) {
+		return strconv.Unquote(s)
+	}
+	if s == "" {
+		return "", errors.New("empty value")
+	}
+	return s, nil
+}
+
+// matches reports whether an event matches the filter. Values are compared as
+// strings; a missing field only matches "!=".
+func (f filter) matches(e axiom.Event) bool {
+	v, ok := lookupField(e, f.path)
+	if !ok {
+		return f.op == opNotEqual
+	}
+	s := filterString(v)
+
+	switch f.op {
+	case opEqual:
+		return s == f.values[0]
+	case opNotEqual:
+		return s != f.values[0]
+	case opStartsWith:
+		return strings.HasPrefix(s, f.values[0])
+	case opEndsWith:
+		return strings.HasSuffix(s, f.values[0])
+	case opContains:
+		return strings.Contains(s, f.values[0])
+	case opIn:
+		return slices.Contains(f.values, s)
+	default:
+		return false
+	}
+}
+
+func filterString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// keep reports whether an event passes the include and exclude filters.
+func keep(e axiom.Event) bool {
+	if len(includeFilters) > 0 && !slices.ContainsFunc(includeFilters, func(f filter) bool { return f.matches(e) }) {
+		return false
+	}
+	return !slices.ContainsFunc(excludeFilters, func(f filter) bool { return f.matches(e) })
+}
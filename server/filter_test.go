@@ -0,0 +1,89 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/axiomhq/axiom-go/axiom"
+)
+
+func TestFilterMatches(t *testing.T) {
+	e := axiom.Event{
+		fieldType: "function",
+		"level":   "debug",
+		fieldRecord: map[string]any{
+			"path":   "/health/live",
+			"status": float64(200),
+		},
+	}
+
+	for expr, want := range map[string]bool{
+		`type == "function"`:                  true,
+		`type != function`:                    false,
+		`record.path startsWith "/health"`:    true,
+		`record.path endsWith live`:           true,
+		`record.path contains "/api"`:         false,
+		`level in [debug, "trace"]`:           true,
+		`level in [info]`:                     false,
+		`record.status == 200`:                true,
+		`record.missing == x`:                 false,
+		`record.missing != x`:                 true,
+		`record.path.deeper startsWith "/he"`: false,
+	} {
+		f, err := parseFilter(expr)
+		if err != nil {
+			t.Fatalf("parse %s: %v", expr, err)
+		}
+		if got := f.matches(e); got != want {
+			t.Errorf("%s: expected %v, got %v", expr, want, got)
+		}
+	}
+}
+
+func TestParseFiltersRejectsInvalidExpressions(t *testing.T) {
+	for _, v := range []string{`type`, `type ~= x`, `level in debug`, `type == "unterminated`} {
+		if _, err := parseFilters(v); err == nil {
+			t.Errorf("expected %q to be rejected", v)
+		}
+	}
+}
+
+func TestParseFiltersKeepsSeparatorsInQuotes(t *testing.T) {
+	filters, err := parseFilters(`record.msg == "a;b"; level in ["x,y", "say \"hi;\""]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 2 {
+		t.Fatalf("expected 2 filters, got %+v", filters)
+	}
+	assertEqual(t, filters[0].values[0], "a;b")
+	if len(filters[1].values) != 2 {
+		t.Fatalf("expected 2 values, got %q", filters[1].values)
+	}
+	assertEqual(t, filters[1].values[0], "x,y")
+	assertEqual(t, filters[1].values[1], `say "hi;"`)
+}
+
+func TestOutputAppliesFilters(t *testing.T) {
+	include, err := parseFilters(`type startsWith platform.; type == function`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclude, err := parseFilters(`type == platform.start`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevInclude, prevExclude := includeFilters, excludeFilters
+	includeFilters, excludeFilters = include, exclude
+	defer func() { includeFilters, excludeFilters = prevInclude, prevExclude }()
+
+	before := health.filtered.Load()
+	out := &output{}
+	for _, typ := range []string{"platform.start", "platform.report", "function", "extension"} {
+		out.add(axiom.Event{fieldType: typ})
+	}
+
+	if out.len() != 2 {
+		t.Fatalf("expected report and function kept, got %v", out.events)
+	}
+	assertEqual(t, health.filtered.Load()-before, int64(2))
+}
@@ -0,0 +1,568 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/axiomhq/axiom-go/axiom"
+
+	"github.com/axiomhq/axiom-lambda-extension/extension"
+	"github.com/axiomhq/axiom-lambda-extension/flusher"
+)
+
+// replay posts a Telemetry API batch through the handler and returns the events
+// that would have been ingested.
+func replay(t *testing.T, h http.Handler, ax *flusher.Axiom, out *bytes.Buffer, body string) []map[string]any {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	out.Reset()
+	ax.Flush(context.Background(), flusher.NoRetry)
+
+	var events []map[string]any
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		var e map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %v", sc.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestHandlerEnrichesBatch(t *testing.T) {
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	h := Handler(ax)
+
+	events := replay(t, h, ax, &out, `[
+		{"time":"2024-01-16T08:53:51.000Z","type":"platform.start","record":{"requestId":"req-1","tracing":{"type":"X-Amzn-Trace-Id","value":"Root=1-abc"}}},
+		{"time":"2024-01-16T08:53:51.100Z","type":"function","record":"plain line\n"},
+		{"time":"2024-01-16T08:53:51.200Z","type":"platform.runtimeDone","record":{"requestId":"req-1","status":"success"}}
+	]`)
+
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	for _, e := range events {
+		if _, ok := e["lambda"].(map[string]any); !ok {
+			t.Fatalf("expected lambda metadata on %v", e[fieldType])
+		}
+		if _, ok := e["axiom"].(map[string]any); !ok {
+			t.Fatalf("expected axiom metadata on %v", e[fieldType])
+		}
+	}
+
+	line := events[1]
+	assertEqual(t, line["_time"], "2024-01-16T08:53:51.100Z")
+	assertEqual(t, line["message"], "plain line\n")
+	assertEqual(t, line["traceId"], "Root=1-abc")
+	assertEqual(t, line[fieldRecord].(map[string]any)[fieldRequestID], "req-1")
+}
+
+func TestHandlerAggregatesRequestIntoWideEvent(t *testing.T) {
+	prev := aggregate
+	aggregate = aggregateOnly
+	defer func() { aggregate = prev }()
+
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	h := Handler(ax)
+
+	const id = "4b995efa-75f8-4fdc-92af-0882c79f47a1"
+	events := replay(t, h, ax, &out, `[
+		{"time":"2024-01-16T08:53:51.000Z","type":"platform.start","record":{"requestId":"`+id+`","tracing":{"type":"X-Amzn-Trace-Id","value":"Root=1-abc"}}},
+		{"time":"2024-01-16T08:53:51.100Z","type":"function","record":"starting\n"},
+		{"time":"2024-01-16T08:53:51.200Z","type":"function","record":"2024-01-16T08:53:51.200Z\t`+id+`\tERROR\tboom"},
+		{"time":"2024-01-16T08:53:51.300Z","type":"platform.runtimeDone","record":{"requestId":"`+id+`","status":"success"}},
+		{"time":"2024-01-16T08:53:51.400Z","type":"platform.report","record":{"requestId":"`+id+`","status":"success","metrics":{"durationMs":300,"billedDurationMs":300,"memorySizeMB":128,"maxMemoryUsedMB":64}}}
+	]`)
+
+	types := make([]any, 0, len(events))
+	for _, e := range events {
+		types = append(types, e[fieldType])
+	}
+	if len(events) != 4 {
+		t.Fatalf("expected platform events and one summary instead of log lines, got %v", types)
+	}
+
+	wide := events[3]
+	assertEqual(t, wide[fieldType], eventTypeInvocation)
+	assertEqual(t, wide[fieldRequestID], id)
+	assertEqual(t, wide["traceId"], "Root=1-abc")
+	assertEqual(t, wide["_time"], "2024-01-16T08:53:51Z")
+
+	details := wide["invocation"].(map[string]any)
+	assertEqual(t, details["logCount"], float64(2))
+	assertEqual(t, details["errorCount"], float64(1))
+	assertEqual(t, details["level"], "error")
+	assertEqual(t, details["firstError"], "boom")
+	assertEqual(t, details["status"], "success")
+	assertEqual(t, details["metrics"].(map[string]any)["billedDurationMs"], float64(300))
+	if lines := details["lines"].([]any); len(lines) != 2 {
+		t.Fatalf("expected 2 lines in summary, got %d", len(lines))
+	}
+}
+
+func TestHandlerDetectsTimeoutAndEmitsErrorEvent(t *testing.T) {
+	prev := errorContextLines
+	errorContextLines = 2
+	defer func() { errorContextLines = prev }()
+
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	h := Handler(ax)
+
+	const id = "4b995efa-75f8-4fdc-92af-0882c79f47a1"
+	events := replay(t, h, ax, &out, `[
+		{"time":"2024-01-16T08:53:51.000Z","type":"platform.start","record":{"requestId":"`+id+`"}},
+		{"time":"2024-01-16T08:53:51.100Z","type":"function","record":"one\n"},
+		{"time":"2024-01-16T08:53:51.200Z","type":"function","record":"two\n"},
+		{"time":"2024-01-16T08:53:54.000Z","type":"platform.runtimeDone","record":{"requestId":"`+id+`","status":"error"}},
+		{"time":"2024-01-16T08:53:54.001Z","type":"function","record":"2024-01-16T08:53:54.001Z `+id+` Task timed out after 3.00 seconds\n"},
+		{"time":"2024-01-16T08:53:54.100Z","type":"platform.report","record":{"requestId":"`+id+`","status":"timeout","metrics":{"durationMs":3000}}}
+	]`)
+
+	if len(events) != 7 {
+		t.Fatalf("expected the batch and one error event, got %d events", len(events))
+	}
+
+	for _, e := range events[:3] {
+		if _, ok := e["lambda"].(map[string]any)["outcome"]; ok {
+			t.Fatalf("expected no outcome before it is known, got %v", e)
+		}
+	}
+
+	done := events[3]["lambda"].(map[string]any)
+	assertEqual(t, done["outcome"], outcomeError)
+
+	timedOut := events[4]["lambda"].(map[string]any)
+	assertEqual(t, timedOut["outcome"], outcomeTimeout)
+	assertEqual(t, timedOut["errorType"], "Sandbox.Timedout")
+
+	report := events[5]["lambda"].(map[string]any)
+	assertEqual(t, report["outcome"], outcomeTimeout)
+	assertEqual(t, report["errorType"], "Sandbox.Timedout")
+
+	errEvent := events[6]
+	assertEqual(t, errEvent[fieldType], eventTypeInvocationError)
+	assertEqual(t, errEvent[fieldRequestID], id)
+	details := errEvent["error"].(map[string]any)
+	assertEqual(t, details["outcome"], outcomeTimeout)
+	lines := details["lines"].([]any)
+	if len(lines) != 2 || lines[0] != "two\n" {
+		t.Fatalf("expected the last 2 lines before the failure, got %v", lines)
+	}
+}
+
+func TestClassifyOutcome(t *testing.T) {
+	for _, tc := range []struct{ status, errorType, want string }{
+		{"success", "", outcomeSuccess},
+		{"error", "Runtime.HandlerError", outcomeError},
+		{"failure", "", outcomeFailure},
+		{"timeout", "", outcomeTimeout},
+		{"error", "Runtime.ExitError", outcomeCrash},
+		{"error", "Runtime.OutOfMemory", outcomeOutOfMemory},
+	} {
+		assertEqual(t, classifyOutcome(tc.status, tc.errorType), tc.want)
+	}
+}
+
+func TestOutcomeTaggedLambdaMetaIsSharedUntilTheOutcomeChanges(t *testing.T) {
+	s := newInvocations()
+	s.start("req-1", time.Now(), "")
+	s.observeOutcome("req-1", outcomeError, "Runtime.HandlerError")
+
+	first := s.lambdaMeta("req-1")
+	assertEqual(t, first["outcome"], outcomeError)
+	first["marker"] = true
+	if s.lambdaMeta("req-1")["marker"] != true {
+		t.Fatal("expected the request's tagged events to share one metadata map")
+	}
+
+	s.observeOutcome("req-1", outcomeTimeout, "Sandbox.Timedout")
+	escalated := s.lambdaMeta("req-1")
+	assertEqual(t, escalated["outcome"], outcomeTimeout)
+	assertEqual(t, escalated["errorType"], "Sandbox.Timedout")
+	assertEqual(t, first["outcome"], outcomeError)
+}
+
+func TestHandlerQueuesLargeBatchInChunks(t *testing.T) {
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	h := Handler(ax)
+
+	const n = queueChunkSize*2 + 5
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = `{"time":"2024-01-16T08:53:51.000Z","type":"function","record":"line"}`
+	}
+
+	events := replay(t, h, ax, &out, "["+strings.Join(lines, ",")+"]")
+	if len(events) != n {
+		t.Fatalf("expected %d events, got %d", n, len(events))
+	}
+	for _, e := range events {
+		if _, ok := e["axiom"].(map[string]any); !ok {
+			t.Fatal("expected axiom metadata on every chunk's events")
+		}
+	}
+}
+
+func TestHandlerStatusCodes(t *testing.T) {
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	h := Handler(ax)
+
+	post := func(body string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		return rec.Code
+	}
+
+	assertEqual(t, post(`{"not":"a batch"}`), http.StatusBadRequest)
+	assertEqual(t, post(`[{"type":"function","record":"cut`), http.StatusBadRequest)
+	assertEqual(t, post(`[]`), http.StatusOK)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", iotest.ErrReader(errors.New("connection reset"))))
+	assertEqual(t, rec.Code, http.StatusInternalServerError)
+}
+
+func TestHandlerPushesBackWhenBufferIsFull(t *testing.T) {
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	h := newHandler(ax, nil)
+
+	for !ax.Full() {
+		ax.QueueEvents(make([]axiom.Event, 1000))
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`[]`)))
+	assertEqual(t, rec.Code, http.StatusServiceUnavailable)
+	assertEqual(t, rec.Header().Get("Retry-After"), "1")
+}
+
+func TestHandlerLetsTheFirstRuntimeDoneThroughAFullBuffer(t *testing.T) {
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	runtimeDone := make(chan struct{})
+	h := newHandler(ax, runtimeDone)
+
+	for !ax.Full() {
+		ax.QueueEvents(make([]axiom.Event, 1000))
+	}
+
+	post := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`[
+			{"time":"2024-01-16T08:53:51.200Z","type":"platform.runtimeDone","record":{"requestId":"req-1","status":"success"}}
+		]`)))
+		return rec.Code
+	}
+
+	assertEqual(t, post(), http.StatusOK)
+	select {
+	case <-runtimeDone:
+	default:
+		t.Fatal("expected platform.runtimeDone to be signalled despite the full buffer")
+	}
+	// Once it was seen, a full buffer pushes back again.
+	assertEqual(t, post(), http.StatusServiceUnavailable)
+}
+
+// outageWriter fails every write while down, like Axiom during an outage.
+type outageWriter struct {
+	buf  bytes.Buffer
+	down bool
+}
+
+func (w *outageWriter) Write(p []byte) (int, error) {
+	if w.down {
+		return 0, errors.New("service unavailable")
+	}
+	return w.buf.Write(p)
+}
+
+func TestHandlerKeepsNewErrorsOverBufferedDebugAcrossAnOutage(t *testing.T) {
+	out := &outageWriter{down: true}
+	ax := flusher.NewWriter(out)
+	h := newHandler(ax, nil)
+
+	debug := make([]axiom.Event, ax.Stats().MaxBuffered)
+	for i := range debug {
+		debug[i] = axiom.Event{"level": "debug"}
+	}
+	ax.QueueEvents(debug)
+	ax.Flush(context.Background(), flusher.NoRetry)
+
+	const id = "4b995efa-75f8-4fdc-92af-0882c79f47a1"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`[
+		{"time":"2024-01-16T08:53:51.200Z","type":"function","record":"2024-01-16T08:53:51.200Z\t`+id+`\tERROR\tboom"},
+		{"time":"2024-01-16T08:53:51.400Z","type":"platform.report","record":{"requestId":"`+id+`","status":"success","metrics":{"durationMs":300}}}
+	]`)))
+	assertEqual(t, rec.Code, http.StatusOK)
+
+	ax.Flush(context.Background(), flusher.NoRetry)
+	out.down = false
+	ax.Flush(context.Background(), flusher.NoRetry)
+
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(&out.buf)
+	for sc.Scan() {
+		var e map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %v", sc.Text(), err)
+		}
+		if e["level"] == "error" {
+			seen["error"] = true
+		}
+		if typ, ok := e[fieldType].(string); ok {
+			seen[typ] = true
+		}
+	}
+	for _, want := range []string{"error", "platform.report", "axiom.eviction"} {
+		if !seen[want] {
+			t.Errorf("expected %s to survive the outage, got %v", want, seen)
+		}
+	}
+}
+
+func TestServerRoutes(t *testing.T) {
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	s := &Server{handler: newHandler(ax, nil)}
+	routes := s.routes()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	assertEqual(t, do(http.MethodGet, "/healthz", "").Code, http.StatusOK)
+	assertEqual(t, do(http.MethodGet, "/readyz", "").Code, http.StatusServiceUnavailable)
+	s.Subscribed()
+	assertEqual(t, do(http.MethodGet, "/readyz", "").Code, http.StatusOK)
+
+	assertEqual(t, do(http.MethodPost, TelemetryPath, `[{"type":"function","record":"hi"}]`).Code, http.StatusOK)
+	assertEqual(t, do(http.MethodPost, "/", `[]`).Code, http.StatusNotFound)
+	assertEqual(t, do(http.MethodGet, "/debug/pprof/", "").Code, http.StatusNotFound)
+
+	var stats struct {
+		Flusher flusher.Stats `json:"flusher"`
+	}
+	rec := do(http.MethodGet, "/debug/stats", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("invalid stats %q: %v", rec.Body.String(), err)
+	}
+	assertEqual(t, stats.Flusher.Buffered, 1)
+}
+
+func BenchmarkHandler(b *testing.B) {
+	const id = "4b995efa-75f8-4fdc-92af-0882c79f47a1"
+	lines := []string{`{"time":"2024-01-16T08:53:51.000Z","type":"platform.start","record":{"requestId":"` + id + `"}}`}
+	for range 500 {
+		lines = append(lines, `{"time":"2024-01-16T08:53:51.100Z","type":"function","record":"2024-01-16T08:53:51.100Z\t`+id+`\tINFO\tprocessing item"}`)
+	}
+	lines = append(lines,
+		`{"time":"2024-01-16T08:53:51.300Z","type":"platform.runtimeDone","record":{"requestId":"`+id+`","status":"success"}}`,
+		`{"time":"2024-01-16T08:53:51.400Z","type":"platform.report","record":{"requestId":"`+id+`","status":"success","metrics":{"durationMs":300}}}`)
+	body := "[" + strings.Join(lines, ",") + "]"
+
+	ax := flusher.NewWriter(io.Discard)
+	h := Handler(ax)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, TelemetryPath, strings.NewReader(body)))
+		ax.Flush(context.Background(), flusher.NoRetry)
+	}
+}
+
+func TestHandlerFoldsRepeatedLines(t *testing.T) {
+	prev := dedupWindow
+	dedupWindow = time.Minute
+	defer func() { dedupWindow = prev }()
+
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	h := Handler(ax)
+
+	const id = "4b995efa-75f8-4fdc-92af-0882c79f47a1"
+	line := func(ts, level, msg string) string {
+		return `{"time":"` + ts + `","type":"function","record":"` + ts + `\t` + id + `\t` + level + `\t` + msg + `"}`
+	}
+	events := replay(t, h, ax, &out, `[
+		{"time":"2024-01-16T08:53:51.000Z","type":"platform.start","record":{"requestId":"`+id+`"}},
+		`+line("2024-01-16T08:53:51.100Z", "WARN", "retrying")+`,
+		`+line("2024-01-16T08:53:51.200Z", "WARN", "retrying")+`,
+		`+line("2024-01-16T08:53:51.250Z", "INFO", "progress")+`,
+		`+line("2024-01-16T08:53:51.300Z", "WARN", "retrying")+`,
+		`+line("2024-01-16T08:53:51.400Z", "WARN", "gave up")+`,
+		{"time":"2024-01-16T08:53:51.500Z","type":"platform.runtimeDone","record":{"requestId":"`+id+`","status":"success"}}
+	]`)
+
+	messages := make([]any, 0, len(events))
+	for _, e := range events {
+		messages = append(messages, eventMessage(e))
+	}
+	if len(events) != 5 {
+		t.Fatalf("expected the repeats folded into one event, got %v", messages)
+	}
+
+	folded := events[1]
+	assertEqual(t, eventMessage(folded), "retrying")
+	assertEqual(t, folded["repeatCount"], float64(3))
+	assertEqual(t, folded["firstTime"], "2024-01-16T08:53:51.100Z")
+	assertEqual(t, folded["lastTime"], "2024-01-16T08:53:51.300Z")
+	assertEqual(t, eventMessage(events[3]), "gave up")
+	if _, ok := events[3]["repeatCount"]; ok {
+		t.Fatal("expected no repeatCount on a line that didn't repeat")
+	}
+	assertEqual(t, events[4][fieldType], "platform.runtimeDone")
+}
+
+func TestDedupTableIsBounded(t *testing.T) {
+	prevWindow, prevMax := dedupWindow, dedupMaxEntries
+	dedupWindow, dedupMaxEntries = time.Minute, 2
+	defer func() { dedupWindow, dedupMaxEntries = prevWindow, prevMax }()
+
+	d := newDedup()
+	now := time.Now()
+	for i, id := range []string{"a", "b", "c"} {
+		done := d.add(axiom.Event{"n": i}, id, "info", "hi", now.Add(time.Duration(i)*time.Millisecond))
+		if i < 2 && len(done) != 0 {
+			t.Fatalf("expected line %d to be held, got %v", i, done)
+		}
+		if i == 2 && (len(done) != 1 || done[0]["n"] != 0) {
+			t.Fatalf("expected the oldest run to make room, got %v", done)
+		}
+	}
+	if len(d.runs) != 2 {
+		t.Fatalf("expected table capped at 2, got %d", len(d.runs))
+	}
+	if done := d.expire(now.Add(time.Hour)); len(done) != 2 {
+		t.Fatalf("expected expired runs to be emitted, got %v", done)
+	}
+}
+
+func TestHandlerExtractsMetrics(t *testing.T) {
+	rules, err := parseMetricRules(`[
+		{"name":"checkout.latency","match":"checkout","regex":"took (\\d+)ms","dimensions":["level"],"drop":true},
+		{"name":"errors","match":"failed","per":"interval"}
+	]`)
+	if err != nil {
+		t.Fatalf("parse rules: %v", err)
+	}
+	prevRules, prevInterval := metricRules, metricsInterval
+	metricRules, metricsInterval = rules, time.Nanosecond
+	defer func() { metricRules, metricsInterval = prevRules, prevInterval }()
+
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	h := Handler(ax)
+
+	const id = "4b995efa-75f8-4fdc-92af-0882c79f47a1"
+	line := func(level, msg string) string {
+		return `{"time":"2024-01-16T08:53:51.100Z","type":"function","record":"2024-01-16T08:53:51.100Z\t` + id + `\t` + level + `\t` + msg + `"}`
+	}
+	events := replay(t, h, ax, &out, `[
+		{"time":"2024-01-16T08:53:51.000Z","type":"platform.start","record":{"requestId":"`+id+`"}},
+		`+line("INFO", "checkout took 120ms")+`,
+		`+line("INFO", "checkout took 80ms")+`,
+		`+line("ERROR", "payment failed")+`,
+		{"time":"2024-01-16T08:53:51.400Z","type":"platform.report","record":{"requestId":"`+id+`","status":"success","metrics":{"durationMs":300}}}
+	]`)
+
+	metrics := map[any]map[string]any{}
+	var forwarded []any
+	for _, e := range events {
+		if e[fieldType] == eventTypeMetric {
+			metrics[e["name"]] = e
+		} else {
+			forwarded = append(forwarded, e[fieldType])
+		}
+	}
+	if len(forwarded) != 3 {
+		t.Fatalf("expected the checkout lines to be dropped, got %v", forwarded)
+	}
+
+	latency := metrics["checkout.latency"]
+	assertEqual(t, latency[fieldRequestID], id)
+	assertEqual(t, latency["count"], float64(2))
+	assertEqual(t, latency["sum"], float64(200))
+	assertEqual(t, latency["min"], float64(80))
+	assertEqual(t, latency["max"], float64(120))
+	assertEqual(t, latency["dimensions"].(map[string]any)["level"], "info")
+
+	errs := metrics["errors"]
+	assertEqual(t, errs["count"], float64(1))
+	if _, ok := errs[fieldRequestID]; ok {
+		t.Fatal("expected interval metrics not to be tied to a request")
+	}
+}
+
+func TestParseMetricRulesRejectsInvalidRules(t *testing.T) {
+	for _, v := range []string{
+		`[{"match":"x"}]`,
+		`[{"name":"a","regex":"(\\d+)","field":"record.n"}]`,
+		`[{"name":"a","regex":"\\d+"}]`,
+		`[{"name":"a","per":"hour"}]`,
+		`{"name":"a"}`,
+	} {
+		if _, err := parseMetricRules(v); err == nil {
+			t.Errorf("expected %s to be rejected", v)
+		}
+	}
+}
+
+func TestServerDrainReleasesHeldEvents(t *testing.T) {
+	prev := dedupWindow
+	dedupWindow = time.Hour
+	defer func() { dedupWindow = prev }()
+
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	s := &Server{handler: newHandler(ax, nil)}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	events := replay(t, s.handler, ax, &out, `[{"time":"`+now+`","type":"function","record":"held"}]`)
+	if len(events) != 0 {
+		t.Fatalf("expected the line to be held, got %d events", len(events))
+	}
+
+	s.Drain()
+	out.Reset()
+	ax.Flush(context.Background(), flusher.NoRetry)
+	if !strings.Contains(out.String(), `"message":"held"`) {
+		t.Fatalf("expected the held line after draining, got %q", out.String())
+	}
+
+	e := ShutdownEvent(extension.ShutdownTimeout, time.UnixMilli(1705395231000), flusher.Stats{Buffered: 3, LastFlushError: "boom"})
+	shutdown := e["shutdown"].(map[string]any)
+	assertEqual(t, e[fieldType], eventTypeShutdown)
+	assertEqual(t, shutdown["reason"], "timeout")
+	assertEqual(t, shutdown["undelivered"], 3)
+	assertEqual(t, shutdown["lastFlushError"], "boom")
+	assertEqual(t, shutdown["deadline"], "2024-01-16T08:53:51Z")
+}
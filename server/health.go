@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/axiomhq/axiom-lambda-extension/telemetryapi"
+)
+
+// health holds the extension's own counters. They are reported in the `axiom`
+// metadata attached to every event so that data loss is visible in the dataset
+// it affects, not only in the function's CloudWatch logs.
+var health struct {
+	// droppedByLambda counts records the Telemetry API discarded because the
+	// extension did not consume them fast enough (platform.logsDropped).
+	droppedByLambda      atomic.Int64
+	droppedByLambdaBytes atomic.Int64
+
+	// filtered counts the events the include and exclude filters dropped.
+	filtered atomic.Int64
+}
+
+// axiomMeta returns a snapshot of the axiom metadata for a batch of events. A
+// fresh map is built per batch because queued events are encoded concurrently
+// by the flusher and must never observe a later counter update.
+func axiomMeta() map[string]any {
+	meta := make(map[string]any, len(axiomMetaInfo)+3)
+	for k, v := range axiomMetaInfo {
+		meta[k] = v
+	}
+	meta["droppedByLambda"] = health.droppedByLambda.Load()
+	meta["droppedByLambdaBytes"] = health.droppedByLambdaBytes.Load()
+	meta["filtered"] = health.filtered.Load()
+	return meta
+}
+
+// recordLogsDropped accounts for a platform.logsDropped event. Lambda sends it
+// when its Telemetry API buffer overflowed because the extension fell behind, so
+// the dropped records never reach us and can't be recovered.
+func recordLogsDropped(record *telemetryapi.LogsDroppedRecord) {
+	records := health.droppedByLambda.Add(record.DroppedRecords)
+	bytes := health.droppedByLambdaBytes.Add(record.DroppedBytes)
+
+	logger.Warn("Lambda dropped telemetry records because the extension fell behind",
+		zap.String("reason", record.Reason),
+		zap.Int64("droppedRecords", record.DroppedRecords),
+		zap.Int64("droppedBytes", record.DroppedBytes),
+		zap.Int64("totalDroppedRecords", records),
+		zap.Int64("totalDroppedBytes", bytes))
+}
+
+// serveHealthz reports that the server is up.
+func serveHealthz(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// serveReadyz reports whether the extension can forward telemetry: it has
+// subscribed to the Telemetry API and has an Axiom client to send with.
+func (s *Server) serveReadyz(w http.ResponseWriter, _ *http.Request) {
+	var problems []string
+	if !s.subscribed.Load() {
+		problems = append(problems, "not subscribed to the Telemetry API")
+	}
+	if s.handler.ax == nil {
+		problems = append(problems, "Axiom client not configured")
+	}
+
+	if len(problems) > 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "not ready", "problems": problems})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ready"})
+}
+
+// serveStats reports the flusher's buffers and the server's counters.
+func (s *Server) serveStats(w http.ResponseWriter, _ *http.Request) {
+	stats := map[string]any{
+		"axiom":              axiomMeta(),
+		"trackedInvocations": s.handler.invocations.len(),
+		"subscribed":         s.subscribed.Load(),
+		"backgroundFlushing": s.handler.flushing.Load(),
+	}
+	if s.handler.ax != nil {
+		stats["flusher"] = s.handler.ax.Stats()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("Error writing response:", zap.Error(err))
+	}
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// maxTrackedInvocations bounds the per-request state so that requests whose
+	// platform.report never arrives can't grow it without bound.
+	maxTrackedInvocations = 1000
+
+	// invocationTTL expires state for requests that never finished. It matches
+	// the maximum Lambda function timeout.
+	invocationTTL = 15 * time.Minute
+)
+
+// invocation is the state kept for a single request, from platform.start until
+// its platform.report.
+type invocation struct {
+	requestID string
+	startTime time.Time
+	traceID   string
+	tenantID  string
+	// functionArn is the ARN the request was invoked with, from INVOKE.
+	functionArn string
+	// running is true until platform.runtimeDone: only then can the function
+	// still produce log lines for the request.
+	running bool
+	// summary accumulates the request's log lines when aggregation is enabled.
+	summary summary
+	// outcome and errorType are the most specific outcome seen so far for the
+	// request (see classifyOutcome).
+	outcome   string
+	errorType string
+	// recent holds the request's last errorContextLines log lines.
+	recent lineRing
+	// metrics aggregates the request's per-invocation metrics.
+	metrics metricSet
+	// meta caches the request's lambda metadata, built from generation metaGen
+	// of the sandbox's (see lambdaMeta), and tagged the same with the outcome
+	// (see taggedLambdaMeta).
+	meta    map[string]any
+	metaGen uint64
+	tagged  map[string]any
+}
+
+// invocations tracks in-flight requests by request ID. On multi-concurrency
+// runtimes several requests share a sandbox and their telemetry interleaves, so
+// nothing about "the current request" may be kept in a single variable.
+type invocations struct {
+	mu   sync.Mutex
+	byID map[string]*invocation
+	// order is the start order of byID's keys, oldest first, for eviction.
+	order []string
+	// evicted holds requests dropped before their platform.report whose
+	// summaries still have to be emitted (see drainEvicted).
+	evicted []invocation
+}
+
+func newInvocations() *invocations {
+	return &invocations{byID: make(map[string]*invocation)}
+}
+
+// start registers a request on platform.start.
+func (s *invocations) start(requestID string, startTime time.Time, traceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv := s.track(requestID, startTime)
+	inv.startTime, inv.traceID, inv.running = startTime, traceID, true
+}
+
+// setTenant records the tenant a request was invoked for. The INVOKE event and
+// platform.start may arrive in either order.
+func (s *invocations) setTenant(requestID, tenantID string) {
+	if tenantID == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.track(requestID, time.Now()).tenantID = tenantID
+}
+
+// invoked records what the INVOKE event tells about a request.
+func (s *invocations) invoked(requestID, tenantID, functionArn string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv := s.track(requestID, time.Now())
+	if tenantID != "" {
+		inv.tenantID = tenantID
+	}
+	inv.functionArn = functionArn
+}
+
+// observeLog adds a log line to a tracked request's recent lines and, when
+// aggregation is enabled, its summary. It reports whether the request is
+// tracked.
+func (s *invocations) observeLog(requestID, level, message string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.byID[requestID]
+	if !ok {
+		return false
+	}
+	if aggregate != aggregateOff {
+		inv.summary.observe(level, message)
+	}
+	inv.recent.push(truncate(message, aggregateMaxLineBytes), errorContextLines)
+	return true
+}
+
+// observeOutcome records an outcome seen for a tracked request, keeping the
+// most specific one.
+func (s *invocations) observeOutcome(requestID, outcome, errorType string) {
+	if outcome == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.byID[requestID]
+	if !ok {
+		return
+	}
+	switch rank, current := outcomeRank[outcome], outcomeRank[inv.outcome]; {
+	case rank > current:
+		inv.outcome = outcome
+		if errorType != "" {
+			inv.errorType = errorType
+		}
+		inv.tagged = nil
+	case rank == current && inv.errorType == "" && errorType != "":
+		inv.errorType = errorType
+		inv.tagged = nil
+	}
+}
+
+// observeMetric adds a value to a tracked request's metrics. It reports
+// whether the request is tracked.
+func (s *invocations) observeMetric(requestID string, rule *metricRule, dims map[string]any, v float64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.byID[requestID]
+	if !ok {
+		return false
+	}
+	if inv.metrics == nil {
+		inv.metrics = make(metricSet)
+	}
+	inv.metrics.observe(rule, dims, v)
+	return true
+}
+
+// track returns the state of a request, creating it if needed. Callers must
+// hold s.mu.
+func (s *invocations) track(requestID string, startTime time.Time) *invocation {
+	if inv, ok := s.byID[requestID]; ok {
+		return inv
+	}
+
+	s.expire(time.Now())
+	for len(s.order) >= maxTrackedInvocations {
+		s.evict(s.order[0])
+	}
+
+	inv := &invocation{requestID: requestID, startTime: startTime}
+	s.byID[requestID] = inv
+	s.order = append(s.order, requestID)
+	return inv
+}
+
+// runtimeDone marks a request's function code as finished.
+func (s *invocations) runtimeDone(requestID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if inv, ok := s.byID[requestID]; ok {
+		inv.running = false
+	}
+}
+
+// finish drops a request's state on platform.report, its last event, and
+// returns it.
+func (s *invocations) finish(requestID string) (invocation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.byID[requestID]
+	if !ok {
+		return invocation{}, false
+	}
+	s.remove(requestID)
+	return *inv, true
+}
+
+// drainEvicted returns the requests evicted or expired since the last call.
+func (s *invocations) drainEvicted() []invocation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	evicted := s.evicted
+	s.evicted = nil
+	return evicted
+}
+
+// lambdaMeta returns the lambda metadata for a request's events, tagged with
+// its outcome once that is known, or the sandbox's for a request that isn't
+// tracked.
+func (s *invocations) lambdaMeta(requestID string) map[string]any {
+	base, gen := versionedLambdaMeta()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.byID[requestID]
+	if !ok {
+		return base
+	}
+	return inv.taggedLambdaMeta(base, gen)
+}
+
+// len returns the number of tracked requests.
+func (s *invocations) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.byID)
+}
+
+// get returns a copy of the state of a tracked request.
+func (s *invocations) get(requestID string) (invocation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.byID[requestID]
+	if !ok {
+		return invocation{}, false
+	}
+	return *inv, true
+}
+
+// sole returns the only running request, which is the one a log line without a
+// request ID of its own belongs to. When several requests are running the owner
+// is ambiguous and no request is returned, so that a line is never attributed
+// to the wrong request.
+func (s *invocations) sole() (invocation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found *invocation
+	for _, inv := range s.byID {
+		if !inv.running {
+			continue
+		}
+		if found != nil {
+			return invocation{}, false
+		}
+		found = inv
+	}
+	if found == nil {
+		return invocation{}, false
+	}
+	return *found, true
+}
+
+// expire drops requests older than invocationTTL. Callers must hold s.mu.
+func (s *invocations) expire(now time.Time) {
+	for len(s.order) > 0 {
+		if inv := s.byID[s.order[0]]; now.Sub(inv.startTime) < invocationTTL {
+			return
+		}
+		s.evict(s.order[0])
+	}
+}
+
+// evict drops a request that didn't finish, keeping its summary and metrics
+// for drainEvicted if it has any. Callers must hold s.mu.
+func (s *invocations) evict(requestID string) {
+	if inv, ok := s.byID[requestID]; ok && (inv.summary.logCount > 0 || len(inv.metrics) > 0) {
+		s.evicted = append(s.evicted, *inv)
+	}
+	s.remove(requestID)
+}
+
+// remove drops a request. Callers must hold s.mu.
+func (s *invocations) remove(requestID string) {
+	if _, ok := s.byID[requestID]; !ok {
+		return
+	}
+	delete(s.byID, requestID)
+	for i, id := range s.order {
+		if id == requestID {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// lineRing keeps the last lines added to it.
+type lineRing struct {
+	lines []string
+	// next is the index the next line goes to once lines is full.
+	next int
+}
+
+// push adds a line, dropping the oldest one once the ring holds size lines.
+func (r *lineRing) push(line string, size int) {
+	switch {
+	case size <= 0:
+		return
+	case len(r.lines) < size:
+		r.lines = append(r.lines, line)
+	default:
+		r.lines[r.next%len(r.lines)] = line
+		r.next = (r.next + 1) % len(r.lines)
+	}
+}
+
+// all returns the lines, oldest first.
+func (r *lineRing) all() []string {
+	out := make([]string, 0, len(r.lines))
+	out = append(out, r.lines[r.next:]...)
+	return append(out, r.lines[:r.next]...)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTagFunctionLogAttributesSoleRunningRequest(t *testing.T) {
+	h := &handler{invocations: newInvocations()}
+	h.invocations.start("req-a", time.Now(), "Root=1-a")
+
+	e := map[string]any{fieldType: eventTypeFunction, fieldRecord: "plain line"}
+	h.tagFunctionLog(e)
+
+	record := e[fieldRecord].(map[string]string)
+	assertEqual(t, record[fieldRequestID], "req-a")
+	assertEqual(t, e["traceId"], "Root=1-a")
+}
+
+func TestTagFunctionLogLeavesInterleavedLinesUntagged(t *testing.T) {
+	h := &handler{invocations: newInvocations()}
+	h.invocations.start("req-a", time.Now(), "Root=1-a")
+	h.invocations.start("req-b", time.Now(), "Root=1-b")
+
+	plain := map[string]any{fieldType: eventTypeFunction, fieldRecord: "plain line"}
+	h.tagFunctionLog(plain)
+	record := plain[fieldRecord].(map[string]string)
+	assertEqual(t, record[fieldRequestID], "")
+	if _, ok := plain["traceId"]; ok {
+		t.Fatal("expected no trace ID on an ambiguous line")
+	}
+
+	// A line carrying its own request ID is still attributed correctly.
+	own := map[string]any{
+		fieldType:   eventTypeFunction,
+		fieldRecord: "2024-01-16T08:53:51.919Z\t00000000-0000-0000-0000-00000000000b\tINFO\thello",
+	}
+	h.invocations.start("00000000-0000-0000-0000-00000000000b", time.Now(), "Root=1-b")
+	h.tagFunctionLog(own)
+	assertEqual(t, own["traceId"], "Root=1-b")
+
+	// Once a request's runtime is done, the remaining one owns untagged lines.
+	h.invocations.runtimeDone("req-b")
+	h.invocations.runtimeDone("00000000-0000-0000-0000-00000000000b")
+	h.tagFunctionLog(plain)
+	record = plain[fieldRecord].(map[string]string)
+	assertEqual(t, record[fieldRequestID], "req-a")
+}
+
+func TestInvocationsAreBounded(t *testing.T) {
+	prev := maxTrackedInvocations
+	maxTrackedInvocations = 2
+	defer func() { maxTrackedInvocations = prev }()
+
+	s := newInvocations()
+	s.start("a", time.Now(), "")
+	s.start("b", time.Now(), "")
+	s.start("c", time.Now(), "")
+
+	if _, ok := s.get("a"); ok {
+		t.Fatal("expected the oldest request to be evicted")
+	}
+	if _, ok := s.get("c"); !ok {
+		t.Fatal("expected the newest request to be tracked")
+	}
+
+	s.finish("b")
+	if _, ok := s.get("b"); ok {
+		t.Fatal("expected finished request to be dropped")
+	}
+}
+
+func TestInvocationsExpireStaleRequests(t *testing.T) {
+	s := newInvocations()
+	s.start("stale", time.Now().Add(-2*invocationTTL), "")
+	s.start("fresh", time.Now(), "")
+
+	if _, ok := s.get("stale"); ok {
+		t.Fatal("expected stale request to expire")
+	}
+}
+
+func TestEventTenantFromInvokeAndRouting(t *testing.T) {
+	prev := tenantDatasetTemplate
+	tenantDatasetTemplate = "logs-{tenant}"
+	defer func() { tenantDatasetTemplate = prev }()
+
+	h := &handler{invocations: newInvocations()}
+	h.invocations.setTenant("req-a", "acme/eu")
+	h.invocations.start("req-a", time.Now(), "")
+
+	tenantID := h.eventTenant("req-a", nil)
+	assertEqual(t, tenantID, "acme/eu")
+	assertEqual(t, tenantDataset(tenantID), "logs-acme_2feu")
+	assertEqual(t, tenantDataset(""), "")
+	assertEqual(t, h.eventTenant("req-unknown", nil), "")
+}
+
+func TestTenantDatasetsDontCollide(t *testing.T) {
+	prev := tenantDatasetTemplate
+	tenantDatasetTemplate = "logs-{tenant}"
+	defer func() { tenantDatasetTemplate = prev }()
+
+	seen := map[string]string{}
+	for _, tenantID := range []string{"acme/eu", "acme-eu", "acme_eu", "acme_2feu", "acme eu", "acmé-eu"} {
+		dataset := tenantDataset(tenantID)
+		if other, ok := seen[dataset]; ok {
+			t.Fatalf("tenants %q and %q both route to %q", other, tenantID, dataset)
+		}
+		seen[dataset] = tenantID
+	}
+	assertEqual(t, tenantDataset("acme-eu"), "logs-acme-eu")
+}
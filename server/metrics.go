@@ -0,0 +1,344 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axiomhq/axiom-go/axiom"
+	"go.uber.org/zap"
+)
+
+const (
+	eventTypeMetric = "axiom.metric"
+
+	metricsPerInvocation = "invocation"
+	metricsPerInterval   = "interval"
+)
+
+var (
+	// metricRules turn matching function log lines into metrics. Set with
+	// AXIOM_METRIC_RULES, a JSON array of rules, e.g.
+	//
+	//	[{"name":"checkout.latency","match":"checkout done","regex":"took (\\d+)ms","dimensions":["record.level"]}]
+	metricRules []*metricRule
+
+	// metricsInterval is how long interval metrics are aggregated for before
+	// they are emitted, with the first batch after it has passed. Override with
+	// AXIOM_METRICS_INTERVAL.
+	metricsInterval = 10 * time.Second
+)
+
+// metricRule derives a metric from log lines. Without Regex or Field it counts
+// the matching lines; otherwise the value is taken from the first group of
+// Regex or from the field at the Field path, and lines without a value are
+// skipped.
+type metricRule struct {
+	Name string `json:"name"`
+	// Match is a regular expression the line's message must match; empty
+	// matches every line.
+	Match string `json:"match,omitempty"`
+	Regex string `json:"regex,omitempty"`
+	Field string `json:"field,omitempty"`
+	// Dimensions are the field paths (e.g. "record.customer") whose values
+	// the metric is broken down by.
+	Dimensions []string `json:"dimensions,omitempty"`
+	// Per is "invocation" (the default) to aggregate per request, or
+	// "interval" to aggregate over metricsInterval.
+	Per string `json:"per,omitempty"`
+	// Drop stops the matching lines from being forwarded themselves.
+	Drop bool `json:"drop,omitempty"`
+
+	match *regexp.Regexp
+	regex *regexp.Regexp
+}
+
+// loadMetricsConfig reads the metric rules and the interval metrics are
+// emitted at. Invalid rules extract no metrics at all, rather than a subset.
+func loadMetricsConfig() {
+	if v := os.Getenv("AXIOM_METRIC_RULES"); v != "" {
+		rules, err := parseMetricRules(v)
+		if err != nil {
+			logger.Warn("invalid AXIOM_METRIC_RULES, no metrics are extracted", zap.Error(err))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_METRIC_RULES: %w", err))
+		} else {
+			metricRules = rules
+		}
+	}
+
+	if v := os.Getenv("AXIOM_METRICS_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			metricsInterval = d
+		} else {
+			logger.Warn("invalid AXIOM_METRICS_INTERVAL, using default",
+				zap.String("value", v), zap.Duration("default", metricsInterval))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_METRICS_INTERVAL %q", v))
+		}
+	}
+}
+
+func parseMetricRules(v string) ([]*metricRule, error) {
+	var rules []*metricRule
+	if err := json.Unmarshal([]byte(v), &rules); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("rule %d: %w", i, err))
+		}
+	}
+	return rules, errors.Join(errs...)
+}
+
+func (r *metricRule) compile() error {
+	if r.Name == "" {
+		return errors.New("missing name")
+	}
+	if r.Regex != "" && r.Field != "" {
+		return fmt.Errorf("%s: regex and field are exclusive", r.Name)
+	}
+	switch r.Per {
+	case "":
+		r.Per = metricsPerInvocation
+	case metricsPerInvocation, metricsPerInterval:
+	default:
+		return fmt.Errorf("%s: invalid per %q", r.Name, r.Per)
+	}
+
+	var err error
+	if r.Match != "" {
+		if r.match, err = regexp.Compile(r.Match); err != nil {
+			return fmt.Errorf("%s: %w", r.Name, err)
+		}
+	}
+	if r.Regex != "" {
+		if r.regex, err = regexp.Compile(r.Regex); err != nil {
+			return fmt.Errorf("%s: %w", r.Name, err)
+		}
+		if r.regex.NumSubexp() < 1 {
+			return fmt.Errorf("%s: regex needs a group to take the value from", r.Name)
+		}
+	}
+	return nil
+}
+
+// value returns the metric value a line yields, if it matches the rule.
+func (r *metricRule) value(e axiom.Event, message string) (float64, bool) {
+	if r.match != nil && !r.match.MatchString(message) {
+		return 0, false
+	}
+
+	switch {
+	case r.regex != nil:
+		m := r.regex.FindStringSubmatch(message)
+		if m == nil {
+			return 0, false
+		}
+		return parseNumber(m[1])
+	case r.Field != "":
+		v, ok := lookupField(e, r.Field)
+		if !ok {
+			return 0, false
+		}
+		return parseNumber(v)
+	default:
+		return 1, true
+	}
+}
+
+// dimensions returns the values of the rule's dimension fields for a line.
+func (r *metricRule) dimensions(e axiom.Event) map[string]any {
+	if len(r.Dimensions) == 0 {
+		return nil
+	}
+	dims := make(map[string]any, len(r.Dimensions))
+	for _, path := range r.Dimensions {
+		if v, ok := lookupField(e, path); ok {
+			dims[path] = v
+		}
+	}
+	return dims
+}
+
+func parseNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// metricAgg aggregates the values of a rule for one set of dimensions.
+type metricAgg struct {
+	name       string
+	dimensions map[string]any
+	count      int
+	sum        float64
+	min        float64
+	max        float64
+}
+
+func (a *metricAgg) observe(v float64) {
+	if a.count == 0 || v < a.min {
+		a.min = v
+	}
+	if a.count == 0 || v > a.max {
+		a.max = v
+	}
+	a.count++
+	a.sum += v
+}
+
+// metricSet holds the aggregates of a scope, keyed by rule and dimensions.
+type metricSet map[string]*metricAgg
+
+func (s metricSet) observe(rule *metricRule, dims map[string]any, v float64) {
+	key := rule.Name
+	if len(dims) > 0 {
+		encoded, _ := json.Marshal(dims) // keys are sorted, so equal sets encode alike
+		key += "\x00" + string(encoded)
+	}
+	agg, ok := s[key]
+	if !ok {
+		agg = &metricAgg{name: rule.Name, dimensions: dims}
+		s[key] = agg
+	}
+	agg.observe(v)
+}
+
+// events returns a metric event per aggregate, in a stable order.
+func (s metricSet) events(time string) []axiom.Event {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	events := make([]axiom.Event, 0, len(s))
+	for _, k := range keys {
+		agg := s[k]
+		e := axiom.Event{
+			"_time":   time,
+			fieldType: eventTypeMetric,
+			"name":    agg.name,
+			"count":   agg.count,
+			"sum":     agg.sum,
+			"min":     agg.min,
+			"max":     agg.max,
+			"lambda":  lambdaMeta(),
+		}
+		if len(agg.dimensions) > 0 {
+			e["dimensions"] = agg.dimensions
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// intervalMetrics aggregates the metrics that aren't per invocation, and those
+// of lines that can't be attributed to a request.
+type intervalMetrics struct {
+	mu    sync.Mutex
+	start time.Time
+	set   metricSet
+}
+
+func (m *intervalMetrics) observe(rule *metricRule, dims map[string]any, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.set == nil {
+		m.set, m.start = make(metricSet), time.Now()
+	}
+	m.set.observe(rule, dims, v)
+}
+
+// due returns the metric events of the interval if it has passed, and starts a
+// new one.
+func (m *intervalMetrics) due(now time.Time) []axiom.Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.start) < metricsInterval {
+		return nil
+	}
+	return m.take(now)
+}
+
+// drain returns the metric events of the interval so far. It is used on
+// shutdown.
+func (m *intervalMetrics) drain(now time.Time) []axiom.Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.take(now)
+}
+
+// take returns the interval's metric events and starts a new interval. Callers
+// must hold m.mu.
+func (m *intervalMetrics) take(now time.Time) []axiom.Event {
+	if len(m.set) == 0 {
+		return nil
+	}
+	events := m.set.events(m.start.UTC().Format(time.RFC3339Nano))
+	for _, e := range events {
+		e["interval"] = now.Sub(m.start).String()
+	}
+	m.set = nil
+	return events
+}
+
+// extractMetrics applies the metric rules to a function log line. It reports
+// whether a rule that drops its lines matched.
+func (h *handler) extractMetrics(e axiom.Event, requestID string) bool {
+	message := eventMessage(e)
+	drop := false
+	for _, rule := range metricRules {
+		v, ok := rule.value(e, message)
+		if !ok {
+			continue
+		}
+		drop = drop || rule.Drop
+
+		dims := rule.dimensions(e)
+		if rule.Per == metricsPerInvocation && h.invocations.observeMetric(requestID, rule, dims, v) {
+			continue
+		}
+		h.intervalMetrics.observe(rule, dims, v)
+	}
+	return drop
+}
+
+// invocationMetricEvents returns the metric events of a finished request.
+func invocationMetricEvents(inv invocation) []axiom.Event {
+	if len(inv.metrics) == 0 {
+		return nil
+	}
+	events := inv.metrics.events(inv.startTime.UTC().Format(time.RFC3339Nano))
+	meta := inv.lambdaMeta(versionedLambdaMeta())
+	for _, e := range events {
+		e["lambda"] = meta
+		e[fieldRequestID] = inv.requestID
+		if inv.tenantID != "" {
+			e[fieldTenantID] = inv.tenantID
+		}
+	}
+	return events
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/axiomhq/axiom-go/axiom"
+	"go.uber.org/zap"
+)
+
+// Normalized invocation outcomes, reported as lambda.outcome. They are ranked
+// by how much they explain: a timeout also shows up as a plain "error" status
+// on some events, so the most specific outcome seen for a request wins.
+const (
+	outcomeSuccess     = "success"
+	outcomeError       = "error"
+	outcomeFailure     = "failure"
+	outcomeCrash       = "crash"
+	outcomeTimeout     = "timeout"
+	outcomeOutOfMemory = "outOfMemory"
+
+	eventTypeInvocationError = "axiom.invocationError"
+)
+
+var outcomeRank = map[string]int{
+	outcomeSuccess:     1,
+	outcomeError:       2,
+	outcomeFailure:     3,
+	outcomeCrash:       4,
+	outcomeTimeout:     5,
+	outcomeOutOfMemory: 6,
+}
+
+var (
+	// errorContextLines is how many of a request's last log lines are copied
+	// into the error event emitted for a failed request; 0 disables the error
+	// event. Lines are not held back until the outcome is known, so the ones
+	// before the event that revealed it go out without lambda.outcome; the
+	// error event is where they are seen with it. Override with
+	// AXIOM_ERROR_CONTEXT_LINES.
+	errorContextLines = 10
+
+	// Lines the Lambda runtime prints when it gives up on an invocation. They
+	// carry the request ID as "RequestId: <id>" or right after the timestamp
+	// without a level, and often arrive after platform.runtimeDone.
+	timeoutLineRgx   = regexp.MustCompile(`Task timed out after`)
+	oomLineRgx       = regexp.MustCompile(`Runtime\.OutOfMemory|signal: killed`)
+	exitLineRgx      = regexp.MustCompile(`Runtime exited with error|Runtime\.ExitError`)
+	lineRequestIDRgx = regexp.MustCompile(`(?:RequestId: |^[0-9.:TZ-]{20,}\s+)([0-9a-f-]{36})`)
+)
+
+// loadOutcomeConfig reads AXIOM_ERROR_CONTEXT_LINES.
+func loadOutcomeConfig() {
+	if v := os.Getenv("AXIOM_ERROR_CONTEXT_LINES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			errorContextLines = n
+		} else {
+			logger.Warn("invalid AXIOM_ERROR_CONTEXT_LINES, using default",
+				zap.String("value", v), zap.Int("default", errorContextLines))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_ERROR_CONTEXT_LINES %q", v))
+		}
+	}
+}
+
+// classifyOutcome normalizes the status and errorType of platform.runtimeDone
+// and platform.report.
+func classifyOutcome(status, errorType string) string {
+	switch {
+	case strings.Contains(errorType, "OutOfMemory"):
+		return outcomeOutOfMemory
+	case status == outcomeTimeout || strings.Contains(errorType, "Timeout") || strings.Contains(errorType, "Timedout"):
+		return outcomeTimeout
+	case errorType == "Runtime.ExitError":
+		return outcomeCrash
+	case status == outcomeSuccess, status == outcomeError, status == outcomeFailure:
+		return status
+	case status == "":
+		return ""
+	default:
+		return outcomeError
+	}
+}
+
+// lineOutcome recognises the runtime's own failure lines in function logs. It
+// returns the outcome, the error type to report for it and the request ID the
+// line names, if any.
+func lineOutcome(message string) (outcome, errorType, requestID string) {
+	switch {
+	case timeoutLineRgx.MatchString(message):
+		outcome, errorType = outcomeTimeout, "Sandbox.Timedout"
+	case oomLineRgx.MatchString(message):
+		outcome, errorType = outcomeOutOfMemory, "Runtime.OutOfMemory"
+	case exitLineRgx.MatchString(message):
+		outcome, errorType = outcomeCrash, "Runtime.ExitError"
+	default:
+		return "", "", ""
+	}
+	if m := lineRequestIDRgx.FindStringSubmatch(message); m != nil {
+		requestID = m[1]
+	}
+	return outcome, errorType, requestID
+}
+
+// taggedLambdaMeta is lambdaMeta with the normalized outcome of the request,
+// once that is known. It is cached alongside lambdaMeta until the outcome
+// changes, so that the request's events keep sharing one map.
+func (inv *invocation) taggedLambdaMeta(base map[string]any, gen uint64) map[string]any {
+	meta := inv.lambdaMeta(base, gen)
+	if inv.outcome == "" {
+		return meta
+	}
+	if inv.tagged == nil {
+		inv.tagged = make(map[string]any, len(meta)+2)
+		for k, v := range meta {
+			inv.tagged[k] = v
+		}
+		inv.tagged["outcome"] = inv.outcome
+		if inv.errorType != "" {
+			inv.tagged["errorType"] = inv.errorType
+		}
+	}
+	return inv.tagged
+}
+
+// invocationErrorEvent builds the event emitted for a request that didn't
+// succeed, with the log lines that led up to the failure.
+func invocationErrorEvent(inv invocation, time string) axiom.Event {
+	e := axiom.Event{
+		"_time":        time,
+		fieldType:      eventTypeInvocationError,
+		fieldRequestID: inv.requestID,
+		"lambda":       inv.taggedLambdaMeta(versionedLambdaMeta()),
+		"error": map[string]any{
+			"outcome":   inv.outcome,
+			"errorType": inv.errorType,
+			"lines":     inv.recent.all(),
+		},
+	}
+	if inv.traceID != "" {
+		e["traceId"] = inv.traceID
+	}
+	if inv.tenantID != "" {
+		e[fieldTenantID] = inv.tenantID
+	}
+	return e
+}
@@ -1,15 +1,23 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/pprof"
 	"regexp"
 
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -17,118 +25,655 @@ import (
 
 	"github.com/axiomhq/axiom-go/axiom"
 
+	"github.com/axiomhq/axiom-lambda-extension/extension"
 	"github.com/axiomhq/axiom-lambda-extension/flusher"
+	"github.com/axiomhq/axiom-lambda-extension/telemetryapi"
 
 	axiomHttp "github.com/axiomhq/pkg/http"
 )
 
-var (
-	logger              *zap.Logger
-	firstInvocationDone = false
-)
+var logger *zap.Logger
 
 var logLineRgx = regexp.MustCompile(`^([0-9.:TZ-]{20,})\s+([0-9a-f-]{36})\s+(ERROR|INFO|WARN|DEBUG|TRACE)\s+(?s:(.*))`)
 
 // Repeated event field/value literals, extracted to satisfy the goconst linter.
 const (
-	eventTypeFunction = "function"
+	eventTypeFunction = string(telemetryapi.Function)
 	fieldType         = "type"
 	fieldRecord       = "record"
 	fieldRequestID    = "requestId"
 )
 
-// lambda environment variables
+// lambda and axiom metadata attached to every event
 var (
-	AWS_LAMBDA_FUNCTION_NAME           = os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
-	AWS_REGION                         = os.Getenv("AWS_REGION")
-	AWS_LAMBDA_FUNCTION_VERSION        = os.Getenv("AWS_LAMBDA_FUNCTION_VERSION")
-	AWS_LAMBDA_INITIALIZATION_TYPE     = os.Getenv("AWS_LAMBDA_INITIALIZATION_TYPE")
-	AWS_LAMBDA_FUNCTION_MEMORY_SIZE, _ = strconv.ParseInt(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"), 10, 32)
-	lambdaMetaInfo                     = map[string]any{}
-	axiomMetaInfo                      = map[string]string{}
+	axiomMetaInfo = map[string]string{}
+
+	// lambdaMetaInfo is shared by every queued event, so it is never mutated in
+	// place: updates swap in a new map under lambdaMetaLock (see updateLambdaMeta).
+	lambdaMetaInfo = map[string]any{}
+	// lambdaMetaGen counts the swaps, so that maps derived from lambdaMetaInfo
+	// can tell when they are stale.
+	lambdaMetaGen  uint64
+	lambdaMetaLock sync.RWMutex
+)
+
+var (
+	// flushOnLogsDropped makes the handler flush right away when Lambda reports
+	// dropped records instead of waiting for the next event, so the buffer drains
+	// sooner under pressure. Enable with AXIOM_FLUSH_ON_LOGS_DROPPED=true.
+	flushOnLogsDropped = false
+
+	// debugPprof serves net/http/pprof under /debug/pprof/. Enable with
+	// AXIOM_DEBUG_PPROF=true.
+	debugPprof = false
+
+	// backgroundFlushTimeout bounds the flushes the handler starts itself, on
+	// dropped records (see flushOnLogsDropped) and when the buffer is full.
+	backgroundFlushTimeout = 5 * time.Second
+
+	// configErrors is reported by ValidateConfig.
+	configErrors []error
 )
 
 func init() {
 	logger, _ = zap.NewProduction()
 
 	// initialize the lambdaMetaInfo map
-	lambdaMetaInfo = map[string]any{
-		"initializationType": AWS_LAMBDA_INITIALIZATION_TYPE,
-		"region":             AWS_REGION,
-		"name":               AWS_LAMBDA_FUNCTION_NAME,
-		"memorySizeMB":       AWS_LAMBDA_FUNCTION_MEMORY_SIZE,
-		"version":            AWS_LAMBDA_FUNCTION_VERSION,
-	}
+	lambdaMetaInfo = loadLambdaMetaInfo()
 	axiomMetaInfo = map[string]string{
 		"awsLambdaExtensionVersion": version.Get(),
 	}
+	for k, v := range flusher.EndpointInfo() {
+		axiomMetaInfo[k] = v
+	}
+
+	if v := os.Getenv("AXIOM_FLUSH_ON_LOGS_DROPPED"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			flushOnLogsDropped = b
+		} else {
+			logger.Warn("invalid AXIOM_FLUSH_ON_LOGS_DROPPED, using default",
+				zap.String("value", v), zap.Bool("default", flushOnLogsDropped))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_FLUSH_ON_LOGS_DROPPED %q", v))
+		}
+	}
+
+	if v := os.Getenv("AXIOM_DEBUG_PPROF"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			debugPprof = b
+		} else {
+			logger.Warn("invalid AXIOM_DEBUG_PPROF, using default",
+				zap.String("value", v), zap.Bool("default", debugPprof))
+			configErrors = append(configErrors, fmt.Errorf("invalid AXIOM_DEBUG_PPROF %q", v))
+		}
+	}
+
+	// the other files' settings are read here, once the logger they warn with
+	// is set up; init functions of their own could run before this one
+	loadCaptureConfig()
+	loadAggregateConfig()
+	loadOutcomeConfig()
+	loadDedupConfig()
+	loadMetricsConfig()
+	loadFilterConfig()
+}
+
+// ValidateConfig reports every problem with the server's configuration: the
+// settings init had to ignore, and settings that would misbehave at runtime.
+func ValidateConfig() []error {
+	errs := append([]error(nil), configErrors...)
+
+	if tenantDatasetTemplate != "" && !strings.Contains(tenantDatasetTemplate, tenantPlaceholder) {
+		errs = append(errs, fmt.Errorf("AXIOM_TENANT_DATASET %q does not contain %s", tenantDatasetTemplate, tenantPlaceholder))
+	}
+	if captureEnabled {
+		if info, err := os.Stat(filepath.Dir(capturePath)); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("AXIOM_CAPTURE_PATH directory %q does not exist", filepath.Dir(capturePath)))
+		}
+	}
+
+	return errs
 }
 
-func New(port string, axiom *flusher.Axiom, runtimeDone chan struct{}) *axiomHttp.Server {
-	s, err := axiomHttp.NewServer(fmt.Sprintf(":%s", port), httpHandler(axiom, runtimeDone))
+// TelemetryPath is the path the Telemetry API listener is served on.
+const TelemetryPath = "/telemetry"
+
+// Server is the HTTP server receiving Telemetry API pushes.
+type Server struct {
+	*axiomHttp.Server
+	handler *handler
+	// tcp is set when the Telemetry API delivers over TCP (see ListenTCP).
+	tcp *tcpListener
+
+	// subscribed is set once the Telemetry API subscription is done.
+	subscribed atomic.Bool
+}
+
+func New(port string, axiom *flusher.Axiom, runtimeDone chan struct{}) *Server {
+	srv := &Server{handler: newHandler(axiom, runtimeDone)}
+	s, err := axiomHttp.NewServer(fmt.Sprintf(":%s", port), srv.routes())
 	if err != nil {
 		logger.Error("Error creating server", zap.Error(err))
 		return nil
 	}
+	srv.Server = s
 
-	return s
+	return srv
 }
 
-func httpHandler(ax *flusher.Axiom, runtimeDone chan struct{}) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			logger.Error("Error reading body:", zap.Error(err))
-			return
+// routes returns the server's routes: the Telemetry API listener, health and
+// readiness checks and the debug endpoints.
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("POST "+TelemetryPath, s.handler)
+	mux.HandleFunc("GET /healthz", serveHealthz)
+	mux.HandleFunc("GET /readyz", s.serveReadyz)
+	mux.HandleFunc("GET /debug/stats", s.serveStats)
+	if debugPprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// Subscribed marks the Telemetry API subscription as done, making the server
+// ready.
+func (s *Server) Subscribed() {
+	s.subscribed.Store(true)
+}
+
+// Handler returns the Telemetry API handler without a server around it, for
+// feeding it recorded payloads. It queues the events it receives into axiom.
+func Handler(axiom *flusher.Axiom) http.Handler {
+	return newHandler(axiom, nil)
+}
+
+// Invoked records what the Extensions API INVOKE event tells about a request
+// that its telemetry doesn't, such as the tenant and the ARN it was invoked
+// with.
+func (s *Server) Invoked(res *extension.NextEventResponse) {
+	s.handler.invocations.invoked(res.RequestID, res.TenantID, res.InvokedFunctionArn)
+}
+
+// handler receives the Telemetry API pushes. It is shared by all requests, which
+// the Telemetry API may send concurrently.
+type handler struct {
+	ax              *flusher.Axiom
+	invocations     *invocations
+	dedup           *dedup
+	intervalMetrics intervalMetrics
+
+	// runtimeDone is closed on the first platform.runtimeDone. Closing (rather
+	// than sending on) the channel never blocks the handler, and the once keeps
+	// overlapping requests from closing it twice.
+	runtimeDone     chan struct{}
+	runtimeDoneOnce sync.Once
+
+	// flushing is set while a flush started by flushInBackground runs.
+	flushing atomic.Bool
+}
+
+func newHandler(ax *flusher.Axiom, runtimeDone chan struct{}) *handler {
+	return &handler{
+		ax:          ax,
+		invocations: newInvocations(),
+		dedup:       newDedup(),
+		runtimeDone: runtimeDone,
+	}
+}
+
+// queueChunkSize is how many events the handler collects before queueing them,
+// trading a little memory for taking the flusher's lock once per chunk rather
+// than once per event.
+const queueChunkSize = 100
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.ax != nil && h.ax.Full() && !h.awaitingRuntimeDone() {
+		// Push back rather than drop: the Telemetry API keeps the batch and
+		// sends it again, by when the flush started here has made room.
+		h.flushInBackground()
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "event buffer full", http.StatusServiceUnavailable)
+		return
+	}
+
+	// The batch is decoded and queued as it is read, so memory use doesn't grow
+	// with the batch size. Only capturing needs the body as sent.
+	var body io.Reader = r.Body
+	var raw *bytes.Buffer
+	if capturer != nil {
+		raw = &bytes.Buffer{}
+		body = io.TeeReader(r.Body, raw)
+	}
+
+	out := &output{}
+	err := telemetryapi.DecodeEvents(body, func(te *telemetryapi.Event) {
+		h.handleEvent(out, te)
+		if out.len() >= queueChunkSize {
+			h.queue(out)
 		}
+	})
+	if err != nil {
+		// the events decoded so far are still forwarded
+		logger.Error("Error decoding body:", zap.Error(err))
+	}
+	status := http.StatusOK
+	switch {
+	case errors.Is(err, telemetryapi.ErrInvalidBatch):
+		status = http.StatusBadRequest
+	case err != nil:
+		status = http.StatusInternalServerError
+	}
 
-		var events []axiom.Event
-		err = json.Unmarshal(body, &events)
-		if err != nil {
-			logger.Error("Error unmarshalling body:", zap.Error(err))
-			return
+	if raw != nil {
+		if _, copyErr := io.Copy(io.Discard, body); copyErr != nil {
+			logger.Error("Error reading body:", zap.Error(copyErr))
 		}
+		capturer.record(r, raw.Bytes())
+	}
 
-		notifyRuntimeDone := false
-		requestID := ""
+	h.finish(out)
 
-		for _, e := range events {
-			if record, ok := e[fieldRecord].(map[string]any); ok {
-				if id, ok := stringField(record, fieldRequestID); ok {
-					requestID = id
-				}
-			}
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+	}
+}
 
-			// attach the lambda information to the event
-			e["lambda"] = lambdaMetaInfo
-			e["axiom"] = axiomMetaInfo
-			// replace the time field with axiom's _time
-			e["_time"], e["time"] = e["time"], nil
+// finish completes a batch: it adds what became due while handling it, queues
+// the events and reacts to what the batch reported.
+func (h *handler) finish(out *output) {
+	if dedupWindow > 0 {
+		for _, done := range h.dedup.expire(time.Now()) {
+			out.add(done)
+		}
+	}
+	for _, inv := range h.invocations.drainEvicted() {
+		if aggregate != aggregateOff {
+			out.add(invocationEvent(inv, nil))
+		}
+		for _, m := range invocationMetricEvents(inv) {
+			out.add(m)
+		}
+	}
+	for _, m := range h.intervalMetrics.due(time.Now()) {
+		out.add(m)
+	}
+	h.queue(out)
 
-			if e[fieldType] == eventTypeFunction {
-				requestID = extractEventMessage(e, requestID)
-			}
+	if out.logsDropped && flushOnLogsDropped {
+		h.flushInBackground()
+	}
 
-			// decide if the handler should notify the extension that the runtime is done
-			if e[fieldType] == "platform.runtimeDone" && !firstInvocationDone {
-				notifyRuntimeDone = true
-			}
+	// inform the extension that platform.runtimeDone event has been received
+	if out.notifyRuntimeDone && h.runtimeDone != nil {
+		h.runtimeDoneOnce.Do(func() { close(h.runtimeDone) })
+	}
+}
+
+// awaitingRuntimeDone reports whether the extension still waits for the first
+// platform.runtimeDone. Until it arrives every batch is let through, full
+// buffer or not: one pushed back might carry it, and holding it back would keep
+// the extension from asking for the next event.
+func (h *handler) awaitingRuntimeDone() bool {
+	if h.runtimeDone == nil {
+		return false
+	}
+	select {
+	case <-h.runtimeDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// flushInBackground drains the buffer without holding up the response; the
+// Telemetry API is waiting on it and delaying it would only make it drop or
+// resend more. Only one such flush runs at a time.
+func (h *handler) flushInBackground() {
+	if h.ax == nil || !h.flushing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer h.flushing.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), backgroundFlushTimeout)
+		defer cancel()
+		h.ax.Flush(ctx, flusher.NoRetry)
+	}()
+}
+
+// queue hands the events collected in out to the flusher and empties it.
+func (h *handler) queue(out *output) {
+	if out.len() == 0 {
+		return
+	}
+
+	// attach the axiom information as of queueing, so the counters include the
+	// chunk's own platform.logsDropped events
+	meta := axiomMeta()
+	for _, e := range out.events {
+		e["axiom"] = meta
+	}
+	for _, dsEvents := range out.routed {
+		for _, e := range dsEvents {
+			e["axiom"] = meta
 		}
+	}
+
+	// queue all the events at once to prevent locking and unlocking the mutex
+	// on each event
+	flusher.SafelyUseAxiomClient(h.ax, func(client *flusher.Axiom) {
+		client.QueueEvents(out.events)
+		for dataset, dsEvents := range out.routed {
+			client.QueueEventsTo(dataset, dsEvents)
+		}
+	})
+
+	out.events, out.routed, out.count = nil, nil, 0
+}
 
-		// queue all the events at once to prevent locking and unlocking the mutex
-		// on each event
-		flusher.SafelyUseAxiomClient(ax, func(client *flusher.Axiom) {
-			client.QueueEvents(events)
+// output collects what handling a batch produced.
+type output struct {
+	events []axiom.Event
+	// routed holds the events of tenants with a dataset of their own
+	routed map[string][]axiom.Event
+
+	// count is the number of events in events and routed
+	count int
+
+	notifyRuntimeDone bool
+	logsDropped       bool
+}
+
+// len returns the number of events collected.
+func (o *output) len() int {
+	return o.count
+}
+
+// add queues an event for its tenant's dataset, or the default one, unless
+// the filters drop it.
+func (o *output) add(e axiom.Event) {
+	if !keep(e) {
+		health.filtered.Add(1)
+		return
+	}
+	o.count++
+	tenantID, _ := e[fieldTenantID].(string)
+	dataset := tenantDataset(tenantID)
+	if dataset == "" {
+		o.events = append(o.events, e)
+		return
+	}
+	if o.routed == nil {
+		o.routed = make(map[string][]axiom.Event)
+	}
+	o.routed[dataset] = append(o.routed[dataset], e)
+}
+
+// handleEvent enriches a single Telemetry API event and adds the events it
+// results in to out.
+func (h *handler) handleEvent(out *output, te *telemetryapi.Event) {
+	record, decodeErr := te.DecodeRecord()
+	if decodeErr != nil {
+		// The event is still forwarded with its generic record, it just
+		// can't take part in routing.
+		logger.Warn("Error decoding record:", zap.String("type", string(te.Type)), zap.Error(decodeErr))
+	}
+
+	e, eventErr := newEvent(te, record)
+	if eventErr != nil {
+		logger.Error("Error unmarshalling record:", zap.Error(eventErr))
+		return
+	}
+
+	requestID, _ := telemetryapi.RequestID(record)
+	var report *telemetryapi.ReportRecord
+
+	switch rec := record.(type) {
+	case *telemetryapi.StartRecord:
+		traceID := ""
+		if rec.Tracing != nil {
+			traceID = rec.Tracing.Value
+		}
+		h.invocations.start(rec.RequestID, eventTime(te), traceID)
+		h.invocations.setTenant(rec.RequestID, rec.TenantID)
+	case *telemetryapi.RuntimeDoneRecord:
+		h.invocations.runtimeDone(rec.RequestID)
+		h.releaseHeld(out, rec.RequestID)
+		h.invocations.observeOutcome(rec.RequestID, classifyOutcome(rec.Status, rec.ErrorType), rec.ErrorType)
+		// decide if the handler should notify the extension that the runtime is done
+		out.notifyRuntimeDone = true
+	case *telemetryapi.ReportRecord:
+		// the request's state is dropped once this event has been tagged
+		report = rec
+		h.releaseHeld(out, rec.RequestID)
+		h.invocations.observeOutcome(rec.RequestID, classifyOutcome(rec.Status, rec.ErrorType), rec.ErrorType)
+	case *telemetryapi.LogsDroppedRecord:
+		recordLogsDropped(rec)
+		out.logsDropped = true
+	case *telemetryapi.InitStartRecord:
+		updateLambdaMeta(func(meta map[string]any) {
+			setIfNotEmpty(meta, "instanceId", rec.InstanceID)
+			setIfNotEmpty(meta, "runtimeVersion", rec.RuntimeVersion)
+		})
+	case *telemetryapi.RestoreStartRecord:
+		handleRestoreStart(h.ax, te)
+		updateLambdaMeta(func(meta map[string]any) {
+			setIfNotEmpty(meta, "instanceId", rec.InstanceID)
+			setIfNotEmpty(meta, "runtimeVersion", rec.RuntimeVersion)
 		})
+	case *telemetryapi.RestoreRuntimeDoneRecord:
+		updateLambdaMeta(func(meta map[string]any) { meta["restoreStatus"] = rec.Status })
+	case *telemetryapi.RestoreReportRecord:
+		updateLambdaMeta(func(meta map[string]any) { meta["restoreDurationMs"] = rec.Metrics.DurationMs })
+	}
+
+	// attach the lambda information to the event, after the switch so
+	// restore events already carry the refreshed metadata
+	e["lambda"] = h.invocations.lambdaMeta(requestID)
+
+	if te.Type == telemetryapi.Function {
+		requestID = h.tagFunctionLog(e)
+		e["lambda"] = h.invocations.lambdaMeta(requestID)
+	}
+
+	if tenantID := h.eventTenant(requestID, record); tenantID != "" {
+		e[fieldTenantID] = tenantID
+	}
 
-		// inform the extension that platform.runtimeDone event has been received
-		if notifyRuntimeDone {
-			runtimeDone <- struct{}{}
-			firstInvocationDone = true
-			// close the channel since it will not be longer used
-			close(runtimeDone)
+	summarised, dropped := false, false
+	if te.Type == telemetryapi.Function {
+		message := eventMessage(e)
+		outcome, errorType, lineID := lineOutcome(message)
+		if requestID == "" && lineID != "" {
+			// the runtime's failure lines name their request themselves
+			requestID = lineID
+			e["lambda"] = h.invocations.lambdaMeta(requestID)
+		}
+		if requestID != "" {
+			tracked := h.invocations.observeLog(requestID, eventLevel(e), message)
+			summarised = tracked && aggregate != aggregateOff
+			h.invocations.observeOutcome(requestID, outcome, errorType)
+			if outcome != "" {
+				// the failure line is tagged with the outcome it revealed
+				e["lambda"] = h.invocations.lambdaMeta(requestID)
+			}
+		}
+		if len(metricRules) > 0 {
+			dropped = h.extractMetrics(e, requestID)
 		}
 	}
+
+	switch {
+	case summarised && aggregate == aggregateOnly:
+		// only forwarded as part of the request's summary
+	case dropped:
+		// only forwarded as a metric
+	case te.Type == telemetryapi.Function && dedupWindow > 0:
+		for _, done := range h.dedup.add(e, requestID, eventLevel(e), eventMessage(e), eventTime(te)) {
+			out.add(done)
+		}
+	default:
+		out.add(e)
+	}
+
+	if report != nil {
+		inv, ok := h.invocations.finish(requestID)
+		if ok && aggregate != aggregateOff {
+			out.add(invocationEvent(inv, report))
+		}
+		for _, m := range invocationMetricEvents(inv) {
+			out.add(m)
+		}
+		if ok && errorContextLines > 0 && inv.outcome != "" && inv.outcome != outcomeSuccess {
+			out.add(invocationErrorEvent(inv, te.Time))
+		}
+	}
+}
+
+// releaseHeld adds the log lines the dedup stage holds for a request that is
+// done.
+func (h *handler) releaseHeld(out *output, requestID string) {
+	if dedupWindow <= 0 {
+		return
+	}
+	for _, done := range h.dedup.release(requestID) {
+		out.add(done)
+	}
+}
+
+// tagFunctionLog normalizes a function log line and attributes it to its
+// request, whose ID it returns. Lines that carry no request ID of their own
+// are only attributed when exactly one request is running; with interleaved
+// requests the owner can't be told and the line is left untagged rather than
+// tagged with the wrong request.
+func (h *handler) tagFunctionLog(e axiom.Event) string {
+	fallbackID := ""
+	sole, ok := h.invocations.sole()
+	if ok {
+		fallbackID = sole.requestID
+	}
+
+	requestID := extractEventMessage(e, fallbackID)
+
+	inv, ok := h.invocations.get(requestID)
+	if ok && inv.traceID != "" {
+		e["traceId"] = inv.traceID
+	}
+	return requestID
+}
+
+// eventTime parses an event's time, falling back to the current time for events
+// without a parsable one.
+func eventTime(te *telemetryapi.Event) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, te.Time); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+// loadLambdaMetaInfo reads the function metadata from the environment.
+func loadLambdaMetaInfo() map[string]any {
+	memorySize, _ := strconv.ParseInt(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"), 10, 32)
+	meta := map[string]any{
+		"initializationType": os.Getenv("AWS_LAMBDA_INITIALIZATION_TYPE"),
+		"region":             os.Getenv("AWS_REGION"),
+		"name":               os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+		"memorySizeMB":       memorySize,
+		"version":            os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+		"architecture":       architecture(),
+	}
+	setIfNotEmpty(meta, "runtime", os.Getenv("AWS_EXECUTION_ENV"))
+	setIfNotEmpty(meta, "logGroupName", os.Getenv("AWS_LAMBDA_LOG_GROUP_NAME"))
+	setIfNotEmpty(meta, "logStreamName", os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME"))
+	return meta
+}
+
+func setIfNotEmpty(m map[string]any, key, value string) {
+	if value != "" {
+		m[key] = value
+	}
+}
+
+func lambdaMeta() map[string]any {
+	lambdaMetaLock.RLock()
+	defer lambdaMetaLock.RUnlock()
+	return lambdaMetaInfo
+}
+
+// versionedLambdaMeta returns the lambda metadata along with its generation.
+func versionedLambdaMeta() (map[string]any, uint64) {
+	lambdaMetaLock.RLock()
+	defer lambdaMetaLock.RUnlock()
+	return lambdaMetaInfo, lambdaMetaGen
+}
+
+// updateLambdaMeta applies update to a copy of the lambda metadata and swaps it
+// in, leaving the map referenced by already queued events untouched.
+func updateLambdaMeta(update func(meta map[string]any)) {
+	lambdaMetaLock.Lock()
+	defer lambdaMetaLock.Unlock()
+
+	meta := make(map[string]any, len(lambdaMetaInfo)+1)
+	for k, v := range lambdaMetaInfo {
+		meta[k] = v
+	}
+	update(meta)
+	lambdaMetaInfo = meta
+	lambdaMetaGen++
+}
+
+// handleRestoreStart resets the state that was frozen into a SnapStart snapshot.
+// Everything captured during init belongs to the sandbox the snapshot was taken
+// in, and many sandboxes can be restored from the same snapshot, so the metadata
+// is reloaded and the flusher drops its pooled connections and flush timer.
+func handleRestoreStart(ax *flusher.Axiom, te *telemetryapi.Event) {
+	meta := loadLambdaMetaInfo()
+	meta["restoredAt"] = te.Time
+
+	lambdaMetaLock.Lock()
+	lambdaMetaInfo = meta
+	lambdaMetaGen++
+	lambdaMetaLock.Unlock()
+
+	flusher.SafelyUseAxiomClient(ax, func(client *flusher.Axiom) {
+		client.Restored()
+	})
+}
+
+// newEvent converts a Telemetry API event into the generic event shipped to
+// Axiom, moving the time field to Axiom's _time. Log records reuse the value
+// already decoded into the typed model; other records are decoded generically
+// so that fields the typed model doesn't know about are still forwarded.
+func newEvent(te *telemetryapi.Event, record any) (axiom.Event, error) {
+	e := axiom.Event{
+		fieldType: string(te.Type),
+		"time":    nil,
+		"_time":   nil,
+	}
+	if te.Time != "" {
+		e["_time"] = te.Time
+	}
+	if len(te.Record) == 0 {
+		return e, nil
+	}
+
+	if logRecord, ok := record.(telemetryapi.LogRecord); ok {
+		if logRecord.Fields != nil {
+			e[fieldRecord] = logRecord.Fields
+		} else {
+			e[fieldRecord] = logRecord.Text
+		}
+		return e, nil
+	}
+
+	var value any
+	if err := json.Unmarshal(te.Record, &value); err != nil {
+		return nil, err
+	}
+	e[fieldRecord] = value
+	return e, nil
 }
 
 // extractEventMessage normalizes Lambda function logs while preserving the raw
@@ -201,6 +746,31 @@ func extractStringRecord(e map[string]any, recordStr string, requestID string) s
 	return requestID
 }
 
+// lookupField returns the value at a dot-separated field path of an event,
+// such as "record.requestId".
+func lookupField(e map[string]any, path string) (any, bool) {
+	var value any = e
+	for _, name := range strings.Split(path, ".") {
+		switch m := value.(type) {
+		case map[string]any:
+			v, ok := m[name]
+			if !ok {
+				return nil, false
+			}
+			value = v
+		case map[string]string:
+			v, ok := m[name]
+			if !ok {
+				return nil, false
+			}
+			value = v
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
 func stringField(record map[string]any, key string) (string, bool) {
 	value, ok := record[key].(string)
 	return value, ok
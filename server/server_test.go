@@ -1,6 +1,11 @@
 package server
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/axiomhq/axiom-lambda-extension/telemetryapi"
+	"github.com/axiomhq/axiom-lambda-extension/version"
+)
 
 func TestExtractEventMessageParsesJSONRecordString(t *testing.T) {
 	rawRecord := `{"level":"INFO","env":"test_creds","app":"aall","requestId":"eb506e5d-e205-4747-870b-b85a48fc2f19","gatewayRequestId":"Root=1-69de4a4b-0d6b7a832500a9a9340fabb1","method":"GET","path":"/brands/cgra8memi4ohud77svp0/overview/2026-03-15/2026-04-14","handler_time_ms":80,"time":"2026-04-14T14:08:11Z","caller":"/home/runner/work/unify/unify/internal/middleware/timing.go:32","message":"request completed"}` + "\n"
@@ -118,3 +123,44 @@ func assertEqual(t *testing.T, got, want any) {
 		t.Fatalf("expected %v, got %v", want, got)
 	}
 }
+
+func TestRecordLogsDroppedUpdatesAxiomMeta(t *testing.T) {
+	before := axiomMeta()["droppedByLambda"].(int64)
+
+	recordLogsDropped(&telemetryapi.LogsDroppedRecord{Reason: "fell behind", DroppedRecords: 7, DroppedBytes: 1024})
+
+	meta := axiomMeta()
+	assertEqual(t, meta["droppedByLambda"], before+7)
+	assertEqual(t, meta["awsLambdaExtensionVersion"], version.Get())
+}
+
+func TestHandleRestoreStartRefreshesLambdaMeta(t *testing.T) {
+	prev := lambdaMeta()
+	defer func() { lambdaMetaInfo = prev }()
+
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "restored-fn")
+	t.Setenv("AWS_LAMBDA_INITIALIZATION_TYPE", "snap-start")
+
+	handleRestoreStart(nil, &telemetryapi.Event{Time: "2024-01-16T08:53:51.919Z", Type: telemetryapi.PlatformRestoreStart})
+	updateLambdaMeta(func(meta map[string]any) { meta["restoreDurationMs"] = 42.0 })
+
+	meta := lambdaMeta()
+	assertEqual(t, meta["name"], "restored-fn")
+	assertEqual(t, meta["initializationType"], "snap-start")
+	assertEqual(t, meta["restoredAt"], "2024-01-16T08:53:51.919Z")
+	assertEqual(t, meta["restoreDurationMs"], 42.0)
+	if _, ok := prev["restoreDurationMs"]; ok {
+		t.Fatal("expected previously published metadata to be left untouched")
+	}
+}
+
+func TestValidateConfigReportsTenantTemplateWithoutPlaceholder(t *testing.T) {
+	prev := tenantDatasetTemplate
+	tenantDatasetTemplate = "logs"
+	defer func() { tenantDatasetTemplate = prev }()
+
+	errs := ValidateConfig()
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly one problem, got %v", errs)
+	}
+}
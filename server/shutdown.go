@@ -0,0 +1,51 @@
+package server
+
+import (
+	"time"
+
+	"github.com/axiomhq/axiom-go/axiom"
+
+	"github.com/axiomhq/axiom-lambda-extension/extension"
+	"github.com/axiomhq/axiom-lambda-extension/flusher"
+)
+
+const eventTypeShutdown = "axiom.shutdown"
+
+// Drain queues everything the handler still holds back, the lines the dedup
+// stage is folding and the interval metrics, for the final flush on shutdown.
+func (s *Server) Drain() {
+	h := s.handler
+	out := &output{}
+	for _, e := range h.dedup.expire(time.Now().Add(dedupWindow)) {
+		out.add(e)
+	}
+	for _, e := range h.intervalMetrics.drain(time.Now()) {
+		out.add(e)
+	}
+	h.queue(out)
+}
+
+// ShutdownEvent returns the last event the extension sends: why the sandbox
+// shut down and what of its telemetry couldn't be delivered. stats is the
+// flusher's state after the final flush.
+func ShutdownEvent(reason extension.ShutdownReason, deadline time.Time, stats flusher.Stats) axiom.Event {
+	shutdown := map[string]any{
+		"reason":      string(reason),
+		"undelivered": stats.Buffered,
+		"dropped":     stats.Dropped,
+	}
+	if !deadline.IsZero() {
+		shutdown["deadline"] = deadline.UTC().Format(time.RFC3339Nano)
+	}
+	if stats.LastFlushError != "" {
+		shutdown["lastFlushError"] = stats.LastFlushError
+	}
+
+	return axiom.Event{
+		"_time":    time.Now().UTC().Format(time.RFC3339Nano),
+		fieldType:  eventTypeShutdown,
+		"shutdown": shutdown,
+		"lambda":   lambdaMeta(),
+		"axiom":    axiomMeta(),
+	}
+}
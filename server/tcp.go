@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/axiomhq/axiom-lambda-extension/telemetryapi"
+)
+
+const (
+	// tcpReadBufferSize is the size of a connection's read buffer; longer lines
+	// are still read whole.
+	tcpReadBufferSize = 64 << 10
+
+	// tcpDrainTimeout is how long the connections keep reading what the
+	// runtime already sent once the listener shuts down.
+	tcpDrainTimeout = 100 * time.Millisecond
+
+	// tcpFullPollInterval is how often a connection held back by a full buffer
+	// checks for room.
+	tcpFullPollInterval = 10 * time.Millisecond
+)
+
+// tcpListener accepts the connections of a Telemetry API TCP destination.
+type tcpListener struct {
+	ln      net.Listener
+	handler *handler
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+	once   sync.Once
+	// done is closed once the listener closes.
+	done chan struct{}
+}
+
+func newTCPListener(ln net.Listener, h *handler) *tcpListener {
+	return &tcpListener{ln: ln, handler: h, conns: map[net.Conn]struct{}{}, done: make(chan struct{})}
+}
+
+// ListenTCP starts accepting Telemetry API deliveries over TCP on port, as
+// newline-delimited JSON. The HTTP listener keeps serving the health and debug
+// endpoints. The listener stops when ctx is done or the server shuts down.
+func (s *Server) ListenTCP(ctx context.Context, port uint16) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	s.tcp = newTCPListener(ln, s.handler)
+	go s.tcp.serve()
+	go func() {
+		<-ctx.Done()
+		s.tcp.close(context.Background())
+	}()
+	return nil
+}
+
+// Shutdown stops the TCP listener, if there is one, and the HTTP server.
+func (s *Server) Shutdown() error {
+	if s.tcp != nil {
+		s.tcp.close(context.Background())
+	}
+	return s.Server.Shutdown()
+}
+
+// ShutdownCtx is Shutdown, giving up on the connections still open when ctx is
+// done.
+func (s *Server) ShutdownCtx(ctx context.Context) error {
+	if s.tcp != nil {
+		s.tcp.close(ctx)
+	}
+	return s.Server.ShutdownCtx(ctx)
+}
+
+func (t *tcpListener) serve() {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error("Error accepting TCP connection:", zap.Error(err))
+			}
+			return
+		}
+
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			conn.Close()
+			return
+		}
+		t.conns[conn] = struct{}{}
+		t.wg.Add(1)
+		t.mu.Unlock()
+
+		go func() {
+			defer t.wg.Done()
+			defer func() {
+				t.mu.Lock()
+				delete(t.conns, conn)
+				t.mu.Unlock()
+				conn.Close()
+			}()
+			t.handler.serveConn(conn, t.done)
+		}()
+	}
+}
+
+// close stops accepting connections and waits for the open ones, which get
+// tcpDrainTimeout to read what the runtime already sent, until ctx is done.
+func (t *tcpListener) close(ctx context.Context) {
+	t.once.Do(func() {
+		_ = t.ln.Close()
+
+		t.mu.Lock()
+		t.closed = true
+		close(t.done)
+		for conn := range t.conns {
+			_ = conn.SetReadDeadline(time.Now().Add(tcpDrainTimeout))
+		}
+		t.mu.Unlock()
+	})
+
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+}
+
+// serveConn handles a Telemetry API TCP connection, one event per line. There
+// are no batches on the wire, so what arrived together is handled as one: the
+// batch ends whenever the read buffer runs dry. A line that doesn't decode is
+// skipped; there is no response to reject it with. The buffer is checked for
+// room after each batch and each queued chunk, and closing done cuts a wait
+// for room short. In capture mode every batch is recorded as a JSON array, the
+// way replay reads batches.
+func (h *handler) serveConn(conn io.Reader, done <-chan struct{}) {
+	r := bufio.NewReaderSize(conn, tcpReadBufferSize)
+	out := &output{}
+	var raw *bytes.Buffer
+	if capturer != nil {
+		raw = &bytes.Buffer{}
+	}
+	for {
+		line, err := r.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if raw != nil {
+				if raw.Len() == 0 {
+					raw.WriteByte('[')
+				} else {
+					raw.WriteByte(',')
+				}
+				raw.Write(line)
+			}
+			if te, decodeErr := telemetryapi.DecodeEvent(line); decodeErr != nil {
+				logger.Error("Error decoding event:", zap.Error(decodeErr))
+			} else {
+				h.handleEvent(out, te)
+			}
+			if out.len() >= queueChunkSize {
+				h.queue(out)
+				h.waitForRoom(done)
+			}
+		}
+
+		drained := r.Buffered() == 0
+		if err != nil || drained {
+			h.finish(out)
+			out = &output{}
+			if raw != nil && raw.Len() > 0 {
+				raw.WriteByte(']')
+				capturer.record(nil, raw.Bytes())
+				raw.Reset()
+			}
+		}
+		if err != nil {
+			var netErr net.Error
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && (!errors.As(err, &netErr) || !netErr.Timeout()) {
+				logger.Error("Error reading TCP connection:", zap.Error(err))
+			}
+			return
+		}
+		if drained {
+			// the batch is done: hold off reading the next until there is room
+			h.waitForRoom(done)
+		}
+	}
+}
+
+// waitForRoom holds a TCP delivery back while the buffer is full, for at most
+// backgroundFlushTimeout or until done is closed. Where the HTTP listener
+// answers 503, not reading lets TCP push back on the runtime until the flush
+// started here made room.
+func (h *handler) waitForRoom(done <-chan struct{}) {
+	if h.ax == nil || !h.ax.Full() || h.awaitingRuntimeDone() {
+		return
+	}
+	h.flushInBackground()
+	timeout := time.NewTimer(backgroundFlushTimeout)
+	defer timeout.Stop()
+	poll := time.NewTicker(tcpFullPollInterval)
+	defer poll.Stop()
+	for h.ax.Full() {
+		select {
+		case <-done:
+			return
+		case <-timeout.C:
+			return
+		case <-poll.C:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axiomhq/axiom-go/axiom"
+
+	"github.com/axiomhq/axiom-lambda-extension/flusher"
+	"github.com/axiomhq/axiom-lambda-extension/telemetryapi"
+)
+
+func TestTCPListenerFeedsTheHandler(t *testing.T) {
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	runtimeDone := make(chan struct{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	l := newTCPListener(ln, newHandler(ax, runtimeDone))
+	go l.serve()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	_, err = conn.Write([]byte(`{"time":"2024-01-16T08:53:51.000Z","type":"platform.start","record":{"requestId":"req-1"}}
+{"time":"2024-01-16T08:53:51.100Z","type":"function","record":"hello"}
+not json
+{"time":"2024-01-16T08:53:51.200Z","type":"platform.runtimeDone","record":{"requestId":"req-1","status":"success"}}
+`))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	<-runtimeDone
+	conn.Close()
+	l.close(context.Background())
+
+	ax.Flush(context.Background(), flusher.NoRetry)
+	var types []string
+	sc := bufio.NewScanner(&out)
+	for sc.Scan() {
+		var e map[string]any
+		if err = json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %v", sc.Text(), err)
+		}
+		types = append(types, e["type"].(string))
+		if e["lambda"] == nil || e["axiom"] == nil {
+			t.Fatalf("expected an enriched event, got %v", e)
+		}
+	}
+	if len(types) != 3 || types[0] != "platform.start" || types[1] != "function" || types[2] != "platform.runtimeDone" {
+		t.Fatalf("expected the decodable lines as events, got %v", types)
+	}
+}
+
+func TestWaitForRoomEndsWhenTheListenerCloses(t *testing.T) {
+	var out bytes.Buffer
+	ax := flusher.NewWriter(&out)
+	h := newHandler(ax, nil)
+	// no flush makes room, so only done ends the wait
+	h.flushing.Store(true)
+	for !ax.Full() {
+		ax.QueueEvents(make([]axiom.Event, 1000))
+	}
+
+	done := make(chan struct{})
+	time.AfterFunc(20*time.Millisecond, func() { close(done) })
+
+	start := time.Now()
+	h.waitForRoom(done)
+	if waited := time.Since(start); waited >= backgroundFlushTimeout {
+		t.Fatalf("expected closing the listener to end the wait, waited %v", waited)
+	}
+}
+
+func TestTCPBatchesAreCapturedForReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.ndjson")
+	prev := capturer
+	capturer = &capture{path: path, maxBytes: 1 << 20}
+	defer func() { capturer = prev }()
+
+	var out bytes.Buffer
+	h := newHandler(flusher.NewWriter(&out), nil)
+	h.serveConn(strings.NewReader(`{"type":"function","record":"one"}`+"\n"+`{"type":"function","record":"two"}`+"\n"), nil)
+
+	records := readCaptureFile(t, path)
+	if len(records) != 1 {
+		t.Fatalf("expected the lines captured as one batch, got %d records", len(records))
+	}
+	payload, err := records[0].Payload()
+	if err != nil {
+		t.Fatalf("payload: %v", err)
+	}
+	var n int
+	if err = telemetryapi.DecodeEvents(bytes.NewReader(payload), func(*telemetryapi.Event) { n++ }); err != nil || n != 2 {
+		t.Fatalf("expected a batch of 2 events, got %d and %v", n, err)
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/axiomhq/axiom-lambda-extension/telemetryapi"
+)
+
+const (
+	fieldTenantID = "tenantId"
+
+	// tenantPlaceholder is replaced by the tenant ID in tenantDatasetTemplate.
+	tenantPlaceholder = "{tenant}"
+)
+
+// tenantDatasetTemplate routes each tenant's events to its own dataset, named
+// by replacing {tenant} in the template (e.g. "logs-{tenant}"). Events without
+// a tenant go to AXIOM_DATASET. Set with AXIOM_TENANT_DATASET; how many tenant
+// datasets may be buffered at once is bounded by AXIOM_MAX_DATASET_BUFFERS.
+var tenantDatasetTemplate = os.Getenv("AXIOM_TENANT_DATASET")
+
+// tenantDataset returns the dataset for a tenant's events, or "" for the
+// default dataset.
+func tenantDataset(tenantID string) string {
+	if tenantID == "" || !strings.Contains(tenantDatasetTemplate, tenantPlaceholder) {
+		return ""
+	}
+	return strings.ReplaceAll(tenantDatasetTemplate, tenantPlaceholder, sanitizeDatasetName(tenantID))
+}
+
+// sanitizeDatasetName escapes the bytes that are not allowed in dataset names
+// as "_" and their hex value. Tenant IDs are chosen by the caller of the
+// function, so they can't be trusted to be valid names. "_" is escaped too,
+// which keeps the mapping one-to-one: "acme/eu" and "acme-eu" must not share a
+// dataset.
+func sanitizeDatasetName(name string) string {
+	var b strings.Builder
+	b.Grow(len(name))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// eventTenant returns the tenant of an event: the one recorded for its request,
+// or one carried by a JSON-formatted log record itself.
+func (h *handler) eventTenant(requestID string, record any) string {
+	if requestID != "" {
+		if inv, ok := h.invocations.get(requestID); ok && inv.tenantID != "" {
+			return inv.tenantID
+		}
+	}
+	if logRecord, ok := record.(telemetryapi.LogRecord); ok {
+		if tenantID, ok := logRecord.Fields[fieldTenantID].(string); ok {
+			return tenantID
+		}
+	}
+	return ""
+}
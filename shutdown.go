@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/axiomhq/axiom-go/axiom"
+	"go.uber.org/zap"
+
+	"github.com/axiomhq/axiom-lambda-extension/extension"
+	"github.com/axiomhq/axiom-lambda-extension/flusher"
+	"github.com/axiomhq/axiom-lambda-extension/server"
+)
+
+var (
+	// shutdownSafetyMargin is kept free before the SHUTDOWN deadline so the
+	// extension exits before Lambda kills it.
+	shutdownSafetyMargin = 50 * time.Millisecond
+
+	// defaultShutdownBudget is used when SHUTDOWN carries no deadline.
+	defaultShutdownBudget = 2 * time.Second
+
+	// shutdownPollInterval is how often buffered telemetry is flushed while
+	// the last Telemetry API batches are still arriving.
+	shutdownPollInterval = 50 * time.Millisecond
+
+	// shutdownFlushReserve is kept for stopping the listener and the final
+	// flush, but never more than half the budget: a short budget is better
+	// split than spent entirely on either.
+	shutdownFlushReserve = 500 * time.Millisecond
+)
+
+// shutdown uses the time until the SHUTDOWN deadline to deliver what is left.
+// Until shutdownFlushReserve before the deadline it keeps the listener open,
+// since the Telemetry API still pushes the last invocation's platform events
+// and log lines, and flushes them as they arrive. The reserve is for stopping
+// the listener, a final flush with retries and an event recording the shutdown
+// and anything that couldn't be delivered. Every step is bounded by the
+// deadline, so the process is never killed before the final flush had its go.
+func shutdown(httpServer *server.Server, ax *flusher.Axiom, res *extension.NextEventResponse) {
+	var deadline time.Time
+	if res.DeadlineMs > 0 {
+		deadline = time.UnixMilli(res.DeadlineMs)
+	}
+	end := deadline
+	if end.IsZero() {
+		end = time.Now().Add(defaultShutdownBudget)
+	}
+	end = end.Add(-shutdownSafetyMargin)
+
+	logger.Info("Shutting down",
+		zap.String("reason", string(res.ShutdownReason)),
+		zap.Duration("budget", time.Until(end)))
+
+	drainEnd := end.Add(-min(shutdownFlushReserve, time.Until(end)/2))
+	for time.Now().Before(drainEnd) {
+		flusher.SafelyUseAxiomClient(ax, func(client *flusher.Axiom) {
+			if client.Stats().Buffered == 0 {
+				return
+			}
+			ctx, cancel := context.WithDeadline(context.Background(), drainEnd)
+			defer cancel()
+			client.Flush(ctx, flusher.Retry)
+		})
+		time.Sleep(min(shutdownPollInterval, time.Until(drainEnd)))
+	}
+
+	// Stopping the listener may take half of what is left; the final flush
+	// gets the rest.
+	stopCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Until(end)/2))
+	_ = httpServer.ShutdownCtx(stopCtx)
+	cancel()
+	httpServer.Drain()
+
+	flusher.SafelyUseAxiomClient(ax, func(client *flusher.Axiom) {
+		ctx, cancel := context.WithDeadline(context.Background(), end)
+		defer cancel()
+
+		client.Flush(ctx, flusher.Retry)
+		client.QueueEvents([]axiom.Event{server.ShutdownEvent(res.ShutdownReason, deadline, client.Stats())})
+		client.Flush(ctx, flusher.Retry)
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/axiomhq/axiom-lambda-extension/telemetryapi"
+)
+
+// Which runtime API the extension subscribes to for logs.
+const (
+	telemetryAPIAuto      = "auto"
+	telemetryAPITelemetry = "telemetry"
+	telemetryAPILogs      = "logs"
+)
+
+// How the Telemetry API delivers events to the extension.
+const (
+	protocolHTTP = "http"
+	protocolTCP  = "tcp"
+)
+
+// telemetryAPI selects the subscription: the Telemetry API, the older Logs
+// API or, with auto, the newest one the environment offers. Local emulators
+// and older runtime environments may only offer the Logs API. Override with
+// AXIOM_TELEMETRY_API.
+var telemetryAPI = telemetryAPIAuto
+
+// subscription is one way to subscribe to logs.
+type subscription struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// subscribe subscribes to the configured API. With auto it tries the
+// Telemetry API at the latest and the first schema version, then the Logs
+// API, moving on when an API rejects the subscription as unsupported.
+func subscribe(ctx context.Context, client *telemetryapi.Client, types []string, bufferingCfg telemetryapi.BufferingCfg, destination telemetryapi.Destination, extensionID string) error {
+	telemetry := func(schemaVersion string) subscription {
+		return subscription{"telemetry " + schemaVersion, func(ctx context.Context) error {
+			client.SchemaVersion = schemaVersion
+			_, err := client.Subscribe(ctx, types, bufferingCfg, destination, extensionID)
+			return err
+		}}
+	}
+	logs := subscription{"logs " + telemetryapi.LogsSchemaVersion20210318, func(ctx context.Context) error {
+		_, err := client.SubscribeLogs(ctx, types, bufferingCfg, destination, extensionID)
+		return err
+	}}
+
+	var subscriptions []subscription
+	switch telemetryAPI {
+	case telemetryAPITelemetry:
+		subscriptions = []subscription{telemetry(telemetryapi.SchemaVersionLatest)}
+	case telemetryAPILogs:
+		subscriptions = []subscription{logs}
+	default:
+		subscriptions = []subscription{
+			telemetry(telemetryapi.SchemaVersionLatest),
+			telemetry(telemetryapi.SchemaVersion20220701),
+			logs,
+		}
+	}
+
+	var err error
+	for i, s := range subscriptions {
+		err = withRetry(ctx, "subscribe", s.fn)
+		if err == nil {
+			logger.Info("subscribed", zap.String("api", s.name))
+			return nil
+		}
+		if i < len(subscriptions)-1 && unsupported(err) {
+			logger.Warn("subscription unsupported, falling back",
+				zap.String("api", s.name), zap.Error(err))
+			continue
+		}
+		break
+	}
+	return err
+}
+
+// unsupported reports whether the runtime rejected a subscription because it
+// doesn't offer the API or schema version. A 400 is not taken as such: it
+// also rejects a subscription that no other API would accept either, such as
+// invalid buffering values, and falling back would hide the real cause.
+func unsupported(err error) bool {
+	var statusErr *telemetryapi.StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/axiomhq/axiom-lambda-extension/telemetryapi"
+)
+
+// fakeRuntime answers subscriptions with the status configured for the
+// endpoint and schema version, and records the attempts.
+type fakeRuntime struct {
+	mu       sync.Mutex
+	status   map[string]int
+	attempts []string
+}
+
+func (f *fakeRuntime) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SchemaVersion string `json:"schemaVersion"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	attempt := r.URL.Path + " " + req.SchemaVersion
+
+	f.mu.Lock()
+	f.attempts = append(f.attempts, attempt)
+	status, ok := f.status[attempt]
+	f.mu.Unlock()
+
+	if ok && status != http.StatusOK {
+		http.Error(w, "rejected", status)
+	}
+}
+
+func subscribeTo(t *testing.T, rt *fakeRuntime, api string) error {
+	t.Helper()
+	fastRetries(t, 1)
+	prev := telemetryAPI
+	telemetryAPI = api
+	t.Cleanup(func() { telemetryAPI = prev })
+
+	srv := httptest.NewServer(rt)
+	t.Cleanup(srv.Close)
+
+	client := telemetryapi.New(strings.TrimPrefix(srv.URL, "http://"))
+	return subscribe(context.Background(), client, []string{"function"}, defaultBufferingCfg(), telemetryapi.Destination{}, "id")
+}
+
+func TestSubscribeFallsBackToTheLogsAPI(t *testing.T) {
+	rt := &fakeRuntime{status: map[string]int{
+		"/2022-07-01/telemetry 2022-12-13": http.StatusNotImplemented,
+		"/2022-07-01/telemetry 2022-07-01": http.StatusNotFound,
+	}}
+	if err := subscribeTo(t, rt, telemetryAPIAuto); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	want := []string{"/2022-07-01/telemetry 2022-12-13", "/2022-07-01/telemetry 2022-07-01", "/2020-08-15/logs 2021-03-18"}
+	if strings.Join(rt.attempts, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected attempts %v, got %v", want, rt.attempts)
+	}
+}
+
+func TestSubscribeReturnsARejectionWithoutFallingBack(t *testing.T) {
+	rt := &fakeRuntime{status: map[string]int{
+		"/2022-07-01/telemetry 2022-12-13": http.StatusBadRequest,
+	}}
+	err := subscribeTo(t, rt, telemetryAPIAuto)
+
+	var statusErr *telemetryapi.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the Telemetry API's rejection, got %v", err)
+	}
+	if len(rt.attempts) != 1 {
+		t.Fatalf("expected no fallback after a rejection, got %v", rt.attempts)
+	}
+}
+
+func TestSubscribeUsesOnlyTheConfiguredAPI(t *testing.T) {
+	rt := &fakeRuntime{status: map[string]int{
+		"/2020-08-15/logs 2021-03-18": http.StatusNotFound,
+	}}
+	if err := subscribeTo(t, rt, telemetryAPILogs); err == nil {
+		t.Fatal("expected the Logs API's error")
+	}
+	if len(rt.attempts) != 1 {
+		t.Fatalf("expected a single attempt, got %v", rt.attempts)
+	}
+}
@@ -0,0 +1,350 @@
+package telemetryapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// EventType is the "type" of a Telemetry API event.
+type EventType string
+
+// Event types documented for the Telemetry API schema 2022-12-13.
+const (
+	PlatformInitStart             EventType = "platform.initStart"
+	PlatformInitRuntimeDone       EventType = "platform.initRuntimeDone"
+	PlatformInitReport            EventType = "platform.initReport"
+	PlatformStart                 EventType = "platform.start"
+	PlatformRuntimeDone           EventType = "platform.runtimeDone"
+	PlatformReport                EventType = "platform.report"
+	PlatformRestoreStart          EventType = "platform.restoreStart"
+	PlatformRestoreRuntimeDone    EventType = "platform.restoreRuntimeDone"
+	PlatformRestoreReport         EventType = "platform.restoreReport"
+	PlatformExtension             EventType = "platform.extension"
+	PlatformTelemetrySubscription EventType = "platform.telemetrySubscription"
+	PlatformLogsDropped           EventType = "platform.logsDropped"
+	Function                      EventType = "function"
+	Extension                     EventType = "extension"
+)
+
+// Event types only sent by the Logs API.
+const (
+	// PlatformEnd is the Logs API's counterpart of platform.runtimeDone.
+	PlatformEnd EventType = "platform.end"
+	// PlatformFault reports a runtime or environment error as a string.
+	PlatformFault EventType = "platform.fault"
+)
+
+// Event is a single Telemetry API event as delivered to the subscribed
+// destination. Time is kept as sent so it can be forwarded verbatim, and Record
+// is kept raw so callers can decode it either into the typed model (see
+// DecodeRecord) or into a generic value for forwarding.
+type Event struct {
+	Time   string          `json:"time"`
+	Type   EventType       `json:"type"`
+	Record json.RawMessage `json:"record,omitempty"`
+}
+
+// Span is a timed phase reported by the platform (e.g. responseLatency).
+type Span struct {
+	Name       string    `json:"name"`
+	Start      time.Time `json:"start"`
+	DurationMs float64   `json:"durationMs"`
+}
+
+// TraceContext is the X-Ray tracing header attached to invocation events.
+type TraceContext struct {
+	SpanID string `json:"spanId,omitempty"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+}
+
+type InitStartRecord struct {
+	InitializationType string `json:"initializationType"`
+	Phase              string `json:"phase"`
+	RuntimeVersion     string `json:"runtimeVersion,omitempty"`
+	RuntimeVersionArn  string `json:"runtimeVersionArn,omitempty"`
+	FunctionName       string `json:"functionName,omitempty"`
+	FunctionVersion    string `json:"functionVersion,omitempty"`
+	InstanceID         string `json:"instanceId,omitempty"`
+	InstanceMaxMemory  int64  `json:"instanceMaxMemory,omitempty"`
+}
+
+type InitRuntimeDoneRecord struct {
+	InitializationType string `json:"initializationType"`
+	Phase              string `json:"phase"`
+	Status             string `json:"status"`
+	ErrorType          string `json:"errorType,omitempty"`
+	Spans              []Span `json:"spans,omitempty"`
+}
+
+type InitReportRecord struct {
+	InitializationType string        `json:"initializationType"`
+	Phase              string        `json:"phase"`
+	Status             string        `json:"status"`
+	ErrorType          string        `json:"errorType,omitempty"`
+	Metrics            ReportMetrics `json:"metrics"`
+	Spans              []Span        `json:"spans,omitempty"`
+}
+
+type StartRecord struct {
+	RequestID string        `json:"requestId"`
+	Version   string        `json:"version,omitempty"`
+	Tracing   *TraceContext `json:"tracing,omitempty"`
+	// TenantID is set for functions using tenant isolation mode.
+	TenantID string `json:"tenantId,omitempty"`
+}
+
+type RuntimeDoneRecord struct {
+	RequestID string              `json:"requestId"`
+	Status    string              `json:"status"`
+	ErrorType string              `json:"errorType,omitempty"`
+	Metrics   *RuntimeDoneMetrics `json:"metrics,omitempty"`
+	Spans     []Span              `json:"spans,omitempty"`
+	Tracing   *TraceContext       `json:"tracing,omitempty"`
+}
+
+type RuntimeDoneMetrics struct {
+	DurationMs    float64 `json:"durationMs"`
+	ProducedBytes int64   `json:"producedBytes,omitempty"`
+}
+
+type ReportRecord struct {
+	RequestID string        `json:"requestId"`
+	Status    string        `json:"status"`
+	ErrorType string        `json:"errorType,omitempty"`
+	Metrics   ReportMetrics `json:"metrics"`
+	Spans     []Span        `json:"spans,omitempty"`
+	Tracing   *TraceContext `json:"tracing,omitempty"`
+}
+
+// ReportMetrics is shared by platform.report, platform.initReport and
+// platform.restoreReport; each only fills in the fields relevant to its phase.
+type ReportMetrics struct {
+	DurationMs              float64 `json:"durationMs"`
+	BilledDurationMs        int64   `json:"billedDurationMs,omitempty"`
+	MemorySizeMB            int64   `json:"memorySizeMB,omitempty"`
+	MaxMemoryUsedMB         int64   `json:"maxMemoryUsedMB,omitempty"`
+	InitDurationMs          float64 `json:"initDurationMs,omitempty"`
+	RestoreDurationMs       float64 `json:"restoreDurationMs,omitempty"`
+	BilledRestoreDurationMs int64   `json:"billedRestoreDurationMs,omitempty"`
+}
+
+type RestoreStartRecord struct {
+	RuntimeVersion    string `json:"runtimeVersion,omitempty"`
+	RuntimeVersionArn string `json:"runtimeVersionArn,omitempty"`
+	FunctionName      string `json:"functionName,omitempty"`
+	FunctionVersion   string `json:"functionVersion,omitempty"`
+	InstanceID        string `json:"instanceId,omitempty"`
+	InstanceMaxMemory int64  `json:"instanceMaxMemory,omitempty"`
+}
+
+type RestoreRuntimeDoneRecord struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType,omitempty"`
+	Spans     []Span `json:"spans,omitempty"`
+}
+
+type RestoreReportRecord struct {
+	Status    string        `json:"status"`
+	ErrorType string        `json:"errorType,omitempty"`
+	Metrics   ReportMetrics `json:"metrics"`
+	Spans     []Span        `json:"spans,omitempty"`
+}
+
+type ExtensionRecord struct {
+	Name      string   `json:"name"`
+	State     string   `json:"state"`
+	Events    []string `json:"events"`
+	ErrorType string   `json:"errorType,omitempty"`
+}
+
+type TelemetrySubscriptionRecord struct {
+	Name  string   `json:"name"`
+	State string   `json:"state"`
+	Types []string `json:"types"`
+}
+
+type LogsDroppedRecord struct {
+	Reason         string `json:"reason"`
+	DroppedRecords int64  `json:"droppedRecords"`
+	DroppedBytes   int64  `json:"droppedBytes"`
+}
+
+// LogRecord is the record of a function or extension log line. Text-format
+// logs arrive as a plain string (Text); JSON-format logs arrive as an object
+// (Fields).
+type LogRecord struct {
+	Text   string
+	Fields map[string]any
+}
+
+// UnknownRecord holds the record of an event type this package does not model.
+type UnknownRecord map[string]any
+
+// DecodeRecord decodes the raw record into the typed model for the event's
+// type. It returns a pointer to one of the *Record structs above, a LogRecord
+// for function and extension logs, or an UnknownRecord for unrecognised types
+// and records that are not objects. A missing record decodes to nil.
+func (e *Event) DecodeRecord() (any, error) {
+	if len(e.Record) == 0 || string(e.Record) == "null" {
+		return nil, nil
+	}
+
+	var rec any
+	switch e.Type {
+	case PlatformInitStart:
+		rec = &InitStartRecord{}
+	case PlatformInitRuntimeDone:
+		rec = &InitRuntimeDoneRecord{}
+	case PlatformInitReport:
+		rec = &InitReportRecord{}
+	case PlatformStart:
+		rec = &StartRecord{}
+	case PlatformRuntimeDone:
+		rec = &RuntimeDoneRecord{}
+	case PlatformReport:
+		rec = &ReportRecord{}
+	case PlatformRestoreStart:
+		rec = &RestoreStartRecord{}
+	case PlatformRestoreRuntimeDone:
+		rec = &RestoreRuntimeDoneRecord{}
+	case PlatformRestoreReport:
+		rec = &RestoreReportRecord{}
+	case PlatformExtension:
+		rec = &ExtensionRecord{}
+	case PlatformTelemetrySubscription:
+		rec = &TelemetrySubscriptionRecord{}
+	case PlatformLogsDropped:
+		rec = &LogsDroppedRecord{}
+	case Function, Extension:
+		return decodeLogRecord(e.Record)
+	default:
+		return decodeUnknownRecord(e.Record)
+	}
+
+	if err := json.Unmarshal(e.Record, rec); err != nil {
+		return nil, fmt.Errorf("decoding %s record: %w", e.Type, err)
+	}
+	return rec, nil
+}
+
+// normalize maps the events of older Logs API and Telemetry API schemas onto
+// the current model, so the rest of the extension handles one model only.
+// Records that merely lack fields, such as a Logs API platform.report without
+// a status, already decode into it.
+func (e *Event) normalize() {
+	if e.Type == PlatformEnd {
+		e.Type = PlatformRuntimeDone
+	}
+}
+
+// ErrInvalidBatch is wrapped by the errors DecodeEvents returns for a batch
+// that isn't valid, as opposed to one that couldn't be read.
+var ErrInvalidBatch = errors.New("invalid batch")
+
+// DecodeEvents decodes a batch of events as posted by the Telemetry API, a JSON
+// array, calling fn with each event as soon as it is decoded so that the batch
+// never has to be held in memory as a whole. A null batch holds no events.
+// Events decoded before an error have already been passed to fn.
+func DecodeEvents(r io.Reader, fn func(e *Event)) error {
+	dec := json.NewDecoder(r)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return batchError("reading batch", err)
+	}
+	if tok == nil {
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("%w: expected an array of events, got %v", ErrInvalidBatch, tok)
+	}
+
+	for dec.More() {
+		var e Event
+		if err = dec.Decode(&e); err != nil {
+			return batchError("decoding event", err)
+		}
+		e.normalize()
+		fn(&e)
+	}
+
+	if _, err = dec.Token(); err != nil {
+		return batchError("reading batch", err)
+	}
+	return nil
+}
+
+// DecodeEvent decodes a single event, one line of what the Telemetry API
+// delivers to a TCP destination.
+func DecodeEvent(data []byte) (*Event, error) {
+	var e Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, batchError("decoding event", err)
+	}
+	e.normalize()
+	return &e, nil
+}
+
+// batchError wraps a decoding error, marking the ones caused by the batch's
+// content with ErrInvalidBatch. A body that ends early is invalid too; any
+// other error comes from the reader.
+func batchError(msg string, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidBatch, msg, err)
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+func decodeLogRecord(raw json.RawMessage) (LogRecord, error) {
+	var value any
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return LogRecord{}, fmt.Errorf("decoding log record: %w", err)
+	}
+	switch v := value.(type) {
+	case string:
+		return LogRecord{Text: v}, nil
+	case map[string]any:
+		return LogRecord{Fields: v}, nil
+	default:
+		return LogRecord{Text: string(raw)}, nil
+	}
+}
+
+func decodeUnknownRecord(raw json.RawMessage) (UnknownRecord, error) {
+	var value any
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("decoding record: %w", err)
+	}
+	if m, ok := value.(map[string]any); ok {
+		return m, nil
+	}
+	return UnknownRecord{"value": value}, nil
+}
+
+// RequestID returns the invocation request ID carried by a decoded record, if
+// any. Function and extension logs only carry one when they are JSON-formatted.
+func RequestID(record any) (string, bool) {
+	switch r := record.(type) {
+	case *StartRecord:
+		return r.RequestID, r.RequestID != ""
+	case *RuntimeDoneRecord:
+		return r.RequestID, r.RequestID != ""
+	case *ReportRecord:
+		return r.RequestID, r.RequestID != ""
+	case LogRecord:
+		id, ok := r.Fields["requestId"].(string)
+		return id, ok
+	case UnknownRecord:
+		id, ok := r["requestId"].(string)
+		return id, ok
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,175 @@
+package telemetryapi
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecodeRecordTypedPlatformEvents(t *testing.T) {
+	body := `[
+		{"time":"2024-01-16T08:53:51.919Z","type":"platform.start","record":{"requestId":"req-1","version":"$LATEST","tracing":{"spanId":"a","type":"X-Amzn-Trace-Id","value":"Root=1-abc"}}},
+		{"time":"2024-01-16T08:53:52.000Z","type":"platform.report","record":{"requestId":"req-1","status":"success","metrics":{"durationMs":12.5,"billedDurationMs":13,"memorySizeMB":128,"maxMemoryUsedMB":64}}},
+		{"time":"2024-01-16T08:53:52.100Z","type":"platform.logsDropped","record":{"reason":"Consumer seems to have fallen behind","droppedRecords":3,"droppedBytes":512}}
+	]`
+
+	var events []Event
+	if err := json.Unmarshal([]byte(body), &events); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	rec, err := events[0].DecodeRecord()
+	if err != nil {
+		t.Fatalf("decode start: %v", err)
+	}
+	start, ok := rec.(*StartRecord)
+	if !ok {
+		t.Fatalf("expected *StartRecord, got %T", rec)
+	}
+	if start.RequestID != "req-1" || start.Tracing == nil || start.Tracing.Value != "Root=1-abc" {
+		t.Fatalf("unexpected start record: %+v", start)
+	}
+
+	rec, err = events[1].DecodeRecord()
+	if err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	report, ok := rec.(*ReportRecord)
+	if !ok {
+		t.Fatalf("expected *ReportRecord, got %T", rec)
+	}
+	if report.Metrics.BilledDurationMs != 13 || report.Metrics.MaxMemoryUsedMB != 64 {
+		t.Fatalf("unexpected report metrics: %+v", report.Metrics)
+	}
+	if id, ok := RequestID(report); !ok || id != "req-1" {
+		t.Fatalf("expected request ID req-1, got %q", id)
+	}
+
+	rec, err = events[2].DecodeRecord()
+	if err != nil {
+		t.Fatalf("decode logsDropped: %v", err)
+	}
+	dropped, ok := rec.(*LogsDroppedRecord)
+	if !ok {
+		t.Fatalf("expected *LogsDroppedRecord, got %T", rec)
+	}
+	if dropped.DroppedRecords != 3 || dropped.DroppedBytes != 512 {
+		t.Fatalf("unexpected logsDropped record: %+v", dropped)
+	}
+}
+
+func TestDecodeRecordLogs(t *testing.T) {
+	text := Event{Type: Function, Record: json.RawMessage(`"hello world\n"`)}
+	rec, err := text.DecodeRecord()
+	if err != nil {
+		t.Fatalf("decode text log: %v", err)
+	}
+	if lr, ok := rec.(LogRecord); !ok || lr.Text != "hello world\n" || lr.Fields != nil {
+		t.Fatalf("unexpected text log record: %#v", rec)
+	}
+
+	structured := Event{Type: Extension, Record: json.RawMessage(`{"requestId":"req-2","message":"hi"}`)}
+	rec, err = structured.DecodeRecord()
+	if err != nil {
+		t.Fatalf("decode JSON log: %v", err)
+	}
+	if id, ok := RequestID(rec); !ok || id != "req-2" {
+		t.Fatalf("expected request ID req-2, got %q", id)
+	}
+}
+
+func TestDecodeRecordUnknownTypeFallsBackToMap(t *testing.T) {
+	e := Event{Type: "platform.somethingNew", Record: json.RawMessage(`{"requestId":"req-3","answer":42}`)}
+	rec, err := e.DecodeRecord()
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	unknown, ok := rec.(UnknownRecord)
+	if !ok {
+		t.Fatalf("expected UnknownRecord, got %T", rec)
+	}
+	if unknown["answer"] != float64(42) {
+		t.Fatalf("expected answer field to survive, got %v", unknown["answer"])
+	}
+
+	missing := Event{Type: PlatformStart}
+	if rec, err = missing.DecodeRecord(); rec != nil || err != nil {
+		t.Fatalf("expected nil record for missing record, got %#v, %v", rec, err)
+	}
+}
+
+func TestDecodeEventsStreamsArray(t *testing.T) {
+	body := `[
+		{"time":"2024-01-16T08:53:51.000Z","type":"platform.start","record":{"requestId":"req-1"}},
+		{"time":"2024-01-16T08:53:51.100Z","type":"function","record":"hello"}
+	]`
+
+	var types []EventType
+	err := DecodeEvents(strings.NewReader(body), func(e *Event) {
+		types = append(types, e.Type)
+	})
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(types) != 2 || types[0] != PlatformStart || types[1] != Function {
+		t.Fatalf("unexpected events: %v", types)
+	}
+
+	if err = DecodeEvents(strings.NewReader("null"), func(*Event) { t.Fatal("unexpected event") }); err != nil {
+		t.Fatalf("expected null batch to decode, got %v", err)
+	}
+	if err = DecodeEvents(strings.NewReader(`{"type":"function"}`), func(*Event) {}); err == nil {
+		t.Fatal("expected error for a batch that isn't an array")
+	}
+
+	var seen int
+	err = DecodeEvents(strings.NewReader(`[{"type":"function","record":"a"},{"type":`), func(*Event) { seen++ })
+	if err == nil || seen != 1 {
+		t.Fatalf("expected the first event before a truncation error, got %d events and %v", seen, err)
+	}
+}
+
+func TestDecodeEventsMarksInvalidBatches(t *testing.T) {
+	for _, body := range []string{"", `{}`, `[{"type":`, `[{"type":42}]`} {
+		if err := DecodeEvents(strings.NewReader(body), func(*Event) {}); !errors.Is(err, ErrInvalidBatch) {
+			t.Errorf("expected ErrInvalidBatch for %q, got %v", body, err)
+		}
+	}
+
+	readErr := errors.New("connection reset")
+	if err := DecodeEvents(iotest.ErrReader(readErr), func(*Event) {}); errors.Is(err, ErrInvalidBatch) || !errors.Is(err, readErr) {
+		t.Errorf("expected the read error, got %v", err)
+	}
+}
+
+func TestDecodeEventsNormalizesLogsAPIEvents(t *testing.T) {
+	body := `[{"time":"2024-01-01T00:00:00Z","type":"platform.end","record":{"requestId":"r1"}},
+		{"time":"2024-01-01T00:00:00Z","type":"platform.report","record":{"requestId":"r1","metrics":{"durationMs":1.5}}},
+		{"time":"2024-01-01T00:00:00Z","type":"function","record":"hello\n"}]`
+
+	var got []Event
+	if err := DecodeEvents(strings.NewReader(body), func(e *Event) { got = append(got, *e) }); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(got))
+	}
+	if got[0].Type != PlatformRuntimeDone {
+		t.Fatalf("expected platform.end as platform.runtimeDone, got %q", got[0].Type)
+	}
+	rec, err := got[0].DecodeRecord()
+	if err != nil {
+		t.Fatalf("decode record: %v", err)
+	}
+	if done, ok := rec.(*RuntimeDoneRecord); !ok || done.RequestID != "r1" {
+		t.Fatalf("expected a runtimeDone record for r1, got %#v", rec)
+	}
+	if rec, err = got[1].DecodeRecord(); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if report, ok := rec.(*ReportRecord); !ok || report.Metrics.DurationMs != 1.5 {
+		t.Fatalf("expected a report without status to decode, got %#v", rec)
+	}
+}
@@ -7,19 +7,47 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
+
+	"github.com/axiomhq/axiom-lambda-extension/internal/apierror"
 )
 
 type Client struct {
 	baseURL    string
+	logsURL    string
 	httpClient *http.Client
+	// Timeout bounds Subscribe and SubscribeLogs.
+	Timeout time.Duration
+	// SchemaVersion is the Telemetry API schema version Subscribe asks for.
+	SchemaVersion string
 }
 
+// StatusError is returned when the Telemetry API responds with an unexpected
+// status.
+type StatusError = apierror.StatusError
+
 type BufferingCfg struct {
 	MaxItems  uint32 `json:"maxItems"`
 	MaxBytes  uint32 `json:"maxBytes"`
 	TimeoutMS uint32 `json:"timeoutMs"`
 }
 
+// Validate checks the buffering configuration against the limits the Telemetry
+// API accepts, which would otherwise only surface as a failed subscription.
+func (b BufferingCfg) Validate() []error {
+	var errs []error
+	if b.MaxItems < 1000 || b.MaxItems > 10000 {
+		errs = append(errs, fmt.Errorf("buffering maxItems %d is outside 1000-10000", b.MaxItems))
+	}
+	if b.MaxBytes < 262144 || b.MaxBytes > 1048576 {
+		errs = append(errs, fmt.Errorf("buffering maxBytes %d is outside 262144-1048576", b.MaxBytes))
+	}
+	if b.TimeoutMS < 25 || b.TimeoutMS > 30000 {
+		errs = append(errs, fmt.Errorf("buffering timeoutMs %d is outside 25-30000", b.TimeoutMS))
+	}
+	return errs
+}
+
 // URI is used to set the endpoint where the logs will be sent to
 type URI string
 
@@ -38,6 +66,9 @@ type HttpProtocol string
 
 const (
 	HttpProto HttpProtocol = "HTTP"
+	// TCPProto delivers events as newline-delimited JSON over a TCP connection
+	// to Destination.Port.
+	TCPProto HttpProtocol = "TCP"
 )
 
 // HttpEncoding denotes what the content is encoded in
@@ -47,10 +78,13 @@ const (
 	JSON HttpEncoding = "JSON"
 )
 
+// Destination is where the runtime delivers events: URI and HttpMethod for
+// HTTP, Port for TCP.
 type Destination struct {
 	Protocol   HttpProtocol `json:"protocol"`
-	URI        URI          `json:"URI"`
-	HttpMethod HttpMethod   `json:"method"`
+	URI        URI          `json:"URI,omitempty"`
+	HttpMethod HttpMethod   `json:"method,omitempty"`
+	Port       uint16       `json:"port,omitempty"`
 	Encoding   HttpEncoding `json:"encoding"`
 }
 
@@ -68,33 +102,80 @@ type SubscribeResponse struct {
 
 const (
 	lambdaAgentIdentifierHeaderKey = "Lambda-Extension-Identifier"
+	SchemaVersion20220701          = "2022-07-01"
 	SchemaVersion20221213          = "2022-12-13"
 	SchemaVersionLatest            = SchemaVersion20221213
+
+	// LogsSchemaVersion20210318 is the latest schema of the Logs API, the
+	// Telemetry API's predecessor.
+	LogsSchemaVersion20210318 = "2021-03-18"
+
+	defaultTimeout = 5 * time.Second
 )
 
 func New(runtimeAPI string) *Client {
 	return &Client{
-		baseURL:    fmt.Sprintf("http://%s/2022-07-01", runtimeAPI),
-		httpClient: &http.Client{},
+		baseURL:       fmt.Sprintf("http://%s/2022-07-01", runtimeAPI),
+		logsURL:       fmt.Sprintf("http://%s/2020-08-15", runtimeAPI),
+		httpClient:    &http.Client{},
+		Timeout:       defaultTimeout,
+		SchemaVersion: SchemaVersionLatest,
 	}
 }
 
 func (lc *Client) Subscribe(ctx context.Context, types []string, bufferingCfg BufferingCfg, destination Destination, extensionID string) (*SubscribeResponse, error) {
-	subscribeEndpoint := lc.baseURL + "/telemetry"
-
-	subReq, err := json.Marshal(
-		&SubscribeRequest{
-			SchemaVersion: SchemaVersionLatest,
-			EventTypes:    types,
-			BufferingCfg:  bufferingCfg,
-			Destination:   destination,
-		},
-	)
+	schemaVersion := lc.SchemaVersion
+	if schemaVersion == "" {
+		schemaVersion = SchemaVersionLatest
+	}
+	return lc.subscribe(ctx, "subscription", lc.baseURL+"/telemetry", &SubscribeRequest{
+		SchemaVersion: schemaVersion,
+		EventTypes:    types,
+		BufferingCfg:  bufferingCfg,
+		Destination:   destination,
+	}, extensionID)
+}
+
+// logsDestination is the destination of a Logs API subscription, which knows
+// no method or encoding.
+type logsDestination struct {
+	Protocol HttpProtocol `json:"protocol"`
+	URI      URI          `json:"URI,omitempty"`
+	Port     uint16       `json:"port,omitempty"`
+}
+
+type logsSubscribeRequest struct {
+	SchemaVersion string          `json:"schemaVersion"`
+	EventTypes    []string        `json:"types"`
+	BufferingCfg  BufferingCfg    `json:"buffering"`
+	Destination   logsDestination `json:"destination"`
+}
+
+// SubscribeLogs subscribes to the Logs API, the Telemetry API's predecessor,
+// for environments that don't offer the Telemetry API. It pushes the same
+// envelope to the destination; DecodeEvents normalizes the differences.
+func (lc *Client) SubscribeLogs(ctx context.Context, types []string, bufferingCfg BufferingCfg, destination Destination, extensionID string) (*SubscribeResponse, error) {
+	return lc.subscribe(ctx, "logs subscription", lc.logsURL+"/logs", &logsSubscribeRequest{
+		SchemaVersion: LogsSchemaVersion20210318,
+		EventTypes:    types,
+		BufferingCfg:  bufferingCfg,
+		Destination:   logsDestination{Protocol: destination.Protocol, URI: destination.URI, Port: destination.Port},
+	}, extensionID)
+}
+
+func (lc *Client) subscribe(ctx context.Context, op, endpoint string, request any, extensionID string) (*SubscribeResponse, error) {
+	if lc.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lc.Timeout)
+		defer cancel()
+	}
+
+	subReq, err := json.Marshal(request)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling subscribeRequest failed")
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "PUT", subscribeEndpoint, bytes.NewBuffer(subReq))
+	httpReq, err := http.NewRequestWithContext(ctx, "PUT", endpoint, bytes.NewBuffer(subReq))
 	if err != nil {
 		return nil, err
 	}
@@ -111,7 +192,7 @@ func (lc *Client) Subscribe(ctx context.Context, types []string, bufferingCfg Bu
 	}
 
 	if httpRes.StatusCode != 200 {
-		return nil, fmt.Errorf("subscription request failed with status %s", httpRes.Status)
+		return nil, &StatusError{Op: op, StatusCode: httpRes.StatusCode, Status: httpRes.Status, Body: string(body)}
 	}
 	return &SubscribeResponse{
 		body: string(body),
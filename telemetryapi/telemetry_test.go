@@ -0,0 +1,83 @@
+package telemetryapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscribeReturnsTypedStatusErrors(t *testing.T) {
+	for status, retryable := range map[int]bool{
+		http.StatusBadRequest:          false,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "nope", status)
+		}))
+		c := New(strings.TrimPrefix(srv.URL, "http://"))
+
+		_, err := c.Subscribe(context.Background(), []string{"function"}, BufferingCfg{}, Destination{}, "id")
+		srv.Close()
+
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) {
+			t.Fatalf("expected a StatusError for %d, got %v", status, err)
+		}
+		if statusErr.StatusCode != status || statusErr.Retryable() != retryable {
+			t.Errorf("status %d: expected retryable %v, got %+v", status, retryable, statusErr)
+		}
+	}
+}
+
+func TestSubscribeTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := New(strings.TrimPrefix(srv.URL, "http://"))
+	c.Timeout = 20 * time.Millisecond
+
+	_, err := c.Subscribe(context.Background(), []string{"function"}, BufferingCfg{}, Destination{}, "id")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the request to time out, got %v", err)
+	}
+}
+
+func TestSubscribeLogsUsesTheLogsAPI(t *testing.T) {
+	var path string
+	var req map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		_ = json.NewDecoder(r.Body).Decode(&req)
+	}))
+	defer srv.Close()
+
+	c := New(strings.TrimPrefix(srv.URL, "http://"))
+	dest := Destination{Protocol: HttpProto, URI: "http://sandbox.localdomain:8080/telemetry", HttpMethod: "POST", Encoding: "JSON"}
+	if _, err := c.SubscribeLogs(context.Background(), []string{"function"}, BufferingCfg{}, dest, "id"); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	if path != "/2020-08-15/logs" {
+		t.Fatalf("expected the Logs API endpoint, got %q", path)
+	}
+	if req["schemaVersion"] != LogsSchemaVersion20210318 {
+		t.Fatalf("expected schema version %s, got %v", LogsSchemaVersion20210318, req["schemaVersion"])
+	}
+	if want := map[string]any{"protocol": "HTTP", "URI": string(dest.URI)}; !reflect.DeepEqual(req["destination"], want) {
+		t.Fatalf("expected destination %v, got %v", want, req["destination"])
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+
+	"github.com/axiomhq/axiom-lambda-extension/flusher"
+	"github.com/axiomhq/axiom-lambda-extension/server"
+)
+
+func validateCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Ingest a single test event into the configured dataset")
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout for the dry-run ingest")
+
+	return &ffcli.Command{
+		Name:       "validate",
+		ShortUsage: "axiom-lambda-extension validate [flags]",
+		ShortHelp:  "check the configuration the extension would run with",
+		LongHelp: "Validate loads the configuration from the environment exactly as the extension " +
+			"does and reports every problem found, exiting non-zero if there is any. With -dry-run " +
+			"it also ingests one test event to check the endpoint, token and dataset.",
+		FlagSet: fs,
+		Exec: func(ctx context.Context, args []string) error {
+			return Validate(ctx, os.Stdout, *dryRun, *timeout)
+		},
+	}
+}
+
+// errInvalidConfig is returned by Validate when it found a problem. It is the
+// only error the extension exits non-zero for.
+var errInvalidConfig = errors.New("invalid configuration")
+
+// Validate writes every configuration problem to w and returns an error
+// wrapping errInvalidConfig if there is any.
+func Validate(ctx context.Context, w io.Writer, dryRun bool, timeout time.Duration) error {
+	var problems []error
+	problems = append(problems, configErrors...)
+	problems = append(problems, defaultBufferingCfg().Validate()...)
+	problems = append(problems, flusher.ValidateConfig()...)
+	problems = append(problems, server.ValidateConfig()...)
+
+	// An ingest can't succeed with an invalid client configuration, so the dry
+	// run is only attempted when everything else checks out.
+	if dryRun && len(problems) == 0 {
+		if err := dryRunIngest(ctx, timeout); err != nil {
+			problems = append(problems, fmt.Errorf("dry-run ingest failed: %w", err))
+		} else {
+			fmt.Fprintln(w, "dry-run ingest succeeded")
+		}
+	}
+
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "configuration is valid")
+		return nil
+	}
+
+	for _, p := range problems {
+		fmt.Fprintf(w, "- %s\n", p)
+	}
+	return fmt.Errorf("%w: found %d problem(s)", errInvalidConfig, len(problems))
+}
+
+func dryRunIngest(ctx context.Context, timeout time.Duration) error {
+	axiom, err := flusher.New()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return axiom.IngestTestEvent(ctx)
+}